@@ -0,0 +1,62 @@
+package main
+
+import "sync"
+
+// actionRing keeps the last actions published on a broadcast channel, so they can be replayed
+// to a connection subscribing later on. A nil actionRing keeps nothing.
+type actionRing struct {
+	lock    sync.Mutex
+	actions []*Action
+	next    int
+	full    bool
+}
+
+// newActionRing creates a ring keeping the last size actions, or nil if size isn't positive.
+func newActionRing(size int) *actionRing {
+	if size <= 0 {
+		return nil
+	}
+
+	return &actionRing{actions: make([]*Action, size)}
+}
+
+// Add stores action, dropping the oldest one when the ring is full.
+func (r *actionRing) Add(action *Action) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.actions[r.next] = action
+	r.next = (r.next + 1) % len(r.actions)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Since returns the stored actions with an index above sinceIndex, oldest first.
+func (r *actionRing) Since(sinceIndex uint64) []*Action {
+	if r == nil {
+		return nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	start, count := 0, r.next
+	if r.full {
+		start, count = r.next, len(r.actions)
+	}
+
+	actions := make([]*Action, 0, count)
+	for i := 0; i < count; i++ {
+		action := r.actions[(start+i)%len(r.actions)]
+		if action.Index > sinceIndex {
+			actions = append(actions, action)
+		}
+	}
+
+	return actions
+}
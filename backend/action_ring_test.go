@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestActionRing(t *testing.T) {
+	cases := []struct {
+		name       string
+		size       int
+		added      []uint64
+		sinceIndex uint64
+		indexes    []uint64
+	}{
+		{"empty", 3, nil, 0, nil},
+		{"not full", 3, []uint64{1, 2}, 0, []uint64{1, 2}},
+		{"full", 3, []uint64{1, 2, 3}, 0, []uint64{1, 2, 3}},
+		{"wrapped around", 3, []uint64{1, 2, 3, 4, 5}, 0, []uint64{3, 4, 5}},
+		{"since an index", 3, []uint64{1, 2, 3, 4, 5}, 3, []uint64{4, 5}},
+		{"since the latest index", 3, []uint64{1, 2, 3}, 3, nil},
+		{"disabled", 0, []uint64{1, 2, 3}, 0, nil},
+	}
+
+	for _, tc := range cases {
+		r := newActionRing(tc.size)
+		for _, index := range tc.added {
+			r.Add(&Action{Type: fetchedConsulServices, Index: index})
+		}
+
+		actions := r.Since(tc.sinceIndex)
+		if len(actions) != len(tc.indexes) {
+			t.Errorf("%s: replayed %d actions, expected %d", tc.name, len(actions), len(tc.indexes))
+			continue
+		}
+
+		for i, index := range tc.indexes {
+			if actions[i].Index != index {
+				t.Errorf("%s: action %d has index %d, expected %d", tc.name, i, actions[i].Index, index)
+			}
+		}
+	}
+}
@@ -1,14 +1,110 @@
 package main
 
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+)
+
 // Action represents a Redux action that is dispatched or received from the store
 // via a websocket connection.
 type Action struct {
 	Type    string
 	Index   uint64
 	Payload interface{}
+	Meta    *ActionMeta `json:",omitempty"`
+
+	// Region is set on the actions of watches spanning several regions
+	Region string `json:",omitempty"`
+
+	// Compressed is set when Payload is the base64 encoded gzip of its JSON encoding
+	Compressed bool `json:",omitempty"`
+
+	// Resync is set on the broadcast sent once a lagging connection caught up, after skipping
+	// the updates its send buffer had no room for
+	Resync bool `json:",omitempty"`
+
+	// Seq numbers the actions sent on a connection from 1, letting the client notice a gap
+	Seq uint64 `json:",omitempty"`
+
+	// RequestID is set by the client on write actions, and echoed on the actions answering them
+	RequestID string `json:",omitempty"`
+}
+
+// sequenceFrame numbers the actions of a frame, a lone action or a batch, continuing from seq.
+// The same action may be queued on several connections, so numbered copies are sent instead.
+func sequenceFrame(frame interface{}, seq *uint64) interface{} {
+	number := func(action *Action) *Action {
+		*seq++
+		numbered := *action
+		numbered.Seq = *seq
+		return &numbered
+	}
+
+	switch f := frame.(type) {
+	case *Action:
+		return number(f)
+	case []*Action:
+		for i := range f {
+			f[i] = number(f[i])
+		}
+	}
+
+	return frame
+}
+
+// gzipAction returns a copy of action with a gzipped payload, if its JSON encoding is over
+// threshold bytes. Smaller actions, and those that don't shrink, are returned as they are.
+func gzipAction(action *Action, threshold int) *Action {
+	payload, err := json.Marshal(action.Payload)
+	if err != nil || len(payload) <= threshold {
+		return action
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(payload); err != nil {
+		return action
+	}
+	if err := w.Close(); err != nil {
+		return action
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(encoded) >= len(payload) {
+		return action
+	}
+
+	compressed := *action
+	compressed.Payload = encoded
+	compressed.Compressed = true
+	return &compressed
+}
+
+// ActionMeta describes how fresh the payload of an action is, for actions built from a stale
+// read or sent to clients asking for it. LastContact is the time since the answering server last
+// heard from the leader, and RequestTime how long the query took, both in milliseconds.
+type ActionMeta struct {
+	LastContact int64
+	KnownLeader bool
+	RequestTime int64
 }
 
 const (
 	errorNotification   = "ERROR_NOTIFICATION"
 	successNotification = "SUCCESS_NOTIFICATION"
 )
+
+// ErrorNotification is the structured payload of an errorNotification raised by a failing watch.
+// Plain errorNotification actions still carry the message as a string payload.
+type ErrorNotification struct {
+	Message  string
+	WatchKey string `json:",omitempty"`
+	Severity string
+}
+
+const (
+	severityWarning = "warning"
+	severityError   = "error"
+)
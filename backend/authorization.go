@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The HTTP endpoints are authorized as pseudo actions, so one ActionAuthorizer covers everything
+// a client can do
+const (
+	downloadConsulSnapshot = "DOWNLOAD_CONSUL_SNAPSHOT"
+	downloadNomadFile      = "DOWNLOAD_NOMAD_FILE"
+	fetchMetrics           = "FETCH_METRICS"
+)
+
+// ConnectionIdentity describes the websocket connection (or HTTP request) an action was
+// received on, for an ActionAuthorizer to decide on
+type ConnectionIdentity struct {
+	// Backend is "consul" or "nomad"
+	Backend string
+
+	// ConnectionID is the short ID the connection is logged with, empty for HTTP requests
+	ConnectionID string
+
+	// RemoteAddr is the address of the client, as seen by hashi-ui
+	RemoteAddr string
+
+	// Token is the Consul ACL token set by the client with SET_CONSUL_TOKEN (or the
+	// X-Consul-Token header of HTTP requests), empty when the default token of hashi-ui is used
+	Token string
+}
+
+// ActionAuthorizer decides whether a connection may run an action, before it is dispatched.
+// Returning an error denies the action, the error is sent to the client as an error
+// notification. It is called for every received action, so it shouldn't block.
+type ActionAuthorizer func(identity ConnectionIdentity, actionType string) error
+
+// authorizeAction is the ActionAuthorizer of all the Consul and Nomad connections. Replace it
+// (before the listener starts) to restrict what connections may do, e.g. only allow the write
+// actions to the tokens of administrators.
+var authorizeAction ActionAuthorizer = allowAllActions
+
+// allowAllActions is the default ActionAuthorizer, letting every connection run every action
+// the read-only settings allow
+func allowAllActions(identity ConnectionIdentity, actionType string) error {
+	return nil
+}
+
+// deniedActionMessage is the error notification sent for an action the authorizer denied
+func deniedActionMessage(actionType string, err error) string {
+	return fmt.Sprintf("Unable to run %s - %s", actionType, err)
+}
+
+// authorizedHandler runs handler only when authorizeAction allows the HTTP request as the
+// pseudo action actionType, and answers 403 otherwise
+func authorizedHandler(backend, actionType string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity := ConnectionIdentity{Backend: backend, RemoteAddr: r.RemoteAddr, Token: r.Header.Get("X-Consul-Token")}
+		if err := authorizeAction(identity, actionType); err != nil {
+			logger.Warningf("Denied %s to %s: %s", actionType, r.RemoteAddr, err)
+			http.Error(w, deniedActionMessage(actionType, err), http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
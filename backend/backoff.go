@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+const (
+	// watchRetryMin is the first delay before a failed watch query is retried
+	watchRetryMin = 1 * time.Second
+
+	// watchRetryMax caps the delay between retries of a failing watch query
+	watchRetryMax = 30 * time.Second
+)
+
+// backoff computes exponentially growing retry delays, doubling from min up to
+// max on every failure. Call Reset after a successful attempt.
+type backoff struct {
+	min      time.Duration
+	max      time.Duration
+	current  time.Duration
+	failures int
+}
+
+// newBackoff creates a backoff starting at min and capped at max.
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{min: min, max: max, current: min}
+}
+
+// Next returns the delay to wait before the next retry and doubles it.
+func (b *backoff) Next() time.Duration {
+	delay := b.current
+
+	b.failures++
+	b.current *= 2
+	if b.current > b.max {
+		b.current = b.max
+	}
+
+	return delay
+}
+
+// Reset starts the delays over from min.
+func (b *backoff) Reset() {
+	b.current = b.min
+	b.failures = 0
+}
+
+// Failures returns the number of consecutive failures since the last Reset.
+func (b *backoff) Failures() int {
+	return b.failures
+}
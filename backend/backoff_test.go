@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	cases := []struct {
+		name   string
+		min    time.Duration
+		max    time.Duration
+		delays []time.Duration
+	}{
+		{
+			name:   "watch retries",
+			min:    watchRetryMin,
+			max:    watchRetryMax,
+			delays: []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second},
+		},
+		{
+			name:   "max is a multiple of min",
+			min:    100 * time.Millisecond,
+			max:    400 * time.Millisecond,
+			delays: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 400 * time.Millisecond},
+		},
+		{
+			name:   "min equals max",
+			min:    5 * time.Second,
+			max:    5 * time.Second,
+			delays: []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+	}
+
+	for _, tc := range cases {
+		b := newBackoff(tc.min, tc.max)
+
+		// a reset after a success starts the delays over, on every round
+		for round := 0; round < 2; round++ {
+			for i, expected := range tc.delays {
+				if delay := b.Next(); delay != expected {
+					t.Errorf("%s: delay %d of round %d is %s, expected %s", tc.name, i, round, delay, expected)
+				}
+			}
+
+			if b.Failures() != len(tc.delays) {
+				t.Errorf("%s: %d failures counted, expected %d", tc.name, b.Failures(), len(tc.delays))
+			}
+
+			b.Reset()
+
+			if b.Failures() != 0 {
+				t.Errorf("%s: %d failures counted after a reset", tc.name, b.Failures())
+			}
+		}
+	}
+}
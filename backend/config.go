@@ -3,7 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 var (
@@ -16,6 +19,24 @@ var (
 	flagListenAddress = flag.String("listen-address", "",
 		"The address on which to expose the web interface. "+flagDefault(defaultConfig.ListenAddress))
 
+	flagWebsocketCompression = flag.Bool("websocket-compression", false,
+		"Whether to negotiate permessage-deflate compression on the websockets. "+flagDefault(strconv.FormatBool(defaultConfig.WebsocketCompression)))
+
+	flagWebsocketReadLimit = flag.Int64("websocket-read-limit", 0,
+		"The maximum size in bytes of a message read from a websocket client. "+flagDefault(strconv.FormatInt(defaultConfig.WebsocketReadLimit, 10)))
+
+	flagWebsocketGzipThreshold = flag.Int("websocket-gzip-threshold", 0,
+		"The payload size in bytes above which actions are gzipped for clients asking for it. "+flagDefault(strconv.Itoa(defaultConfig.WebsocketGzipThreshold)))
+
+	flagWebsocketAllowedOrigins = flag.String("websocket-allowed-origins", "",
+		"Comma separated origins (or host names) websockets are accepted from, all when empty. "+flagDefault(strings.Join(defaultConfig.WebsocketAllowedOrigins, ",")))
+
+	flagConnectionIDLength = flag.Int("connection-id-length", 0,
+		"The number of UUID digits connections are logged with, from 8 to 32. "+flagDefault(strconv.Itoa(defaultConfig.ConnectionIDLength)))
+
+	flagConnectionIDCounter = flag.Bool("connection-id-counter", false,
+		"Whether to append a sequence number to the connection IDs, making them unique. "+flagDefault(strconv.FormatBool(defaultConfig.ConnectionIDCounter)))
+
 	flagNewRelicAppName = flag.String("newrelic-app-name", "hashi-ui",
 		"The NewRelic app name. "+flagDefault(defaultConfig.NewRelicAppName))
 
@@ -25,9 +46,15 @@ var (
 
 // Config for the hashi-ui server
 type Config struct {
-	LogLevel      string
-	ProxyAddress  string
-	ListenAddress string
+	LogLevel                string
+	ProxyAddress            string
+	ListenAddress           string
+	WebsocketCompression    bool
+	WebsocketReadLimit      int64
+	WebsocketGzipThreshold  int
+	WebsocketAllowedOrigins []string
+	ConnectionIDLength      int
+	ConnectionIDCounter     bool
 
 	NewRelicAppName string
 	NewRelicLicense string
@@ -40,9 +67,21 @@ type Config struct {
 	NomadReadOnly   bool
 	NomadSkipVerify bool
 
-	ConsulEnable   bool
-	ConsulReadOnly bool
-	ConsulAddress  string
+	ConsulEnable     bool
+	ConsulReadOnly   bool
+	ConsulAddress    string
+	ConsulACLToken   string
+	ConsulCACert     string
+	ConsulClientCert string
+	ConsulClientKey  string
+	ConsulSkipVerify bool
+	ConsulSendBuffer int
+	ConsulMaxWatches int
+	ConsulWaitTime   time.Duration
+
+	ConsulRequestTimeout time.Duration
+	ConsulIdleTimeout    time.Duration
+	ConsulReplayBuffer   int
 }
 
 // DefaultConfig is the basic out-of-the-box configuration for hashi-ui
@@ -51,13 +90,23 @@ func DefaultConfig() *Config {
 		LogLevel:      "info",
 		ListenAddress: "0.0.0.0:3000",
 
+		WebsocketReadLimit:     512 * 1024,
+		WebsocketGzipThreshold: 256 * 1024,
+
+		ConnectionIDLength: 8,
+
 		NewRelicAppName: "hashi-ui",
 
 		NomadReadOnly: false,
 		NomadAddress:  "http://127.0.0.1:4646",
 
-		ConsulReadOnly: false,
-		ConsulAddress:  "127.0.0.1:8500",
+		ConsulReadOnly:   false,
+		ConsulAddress:    "127.0.0.1:8500",
+		ConsulSendBuffer: 100,
+		ConsulMaxWatches: 100,
+		ConsulWaitTime:   120 * time.Second,
+
+		ConsulRequestTimeout: 15 * time.Second,
 	}
 }
 
@@ -81,6 +130,42 @@ func ParseAppEnvConfig(c *Config) {
 	if ok {
 		c.ListenAddress = listenAddress
 	}
+
+	websocketCompression, ok := syscall.Getenv("WEBSOCKET_COMPRESSION")
+	if ok {
+		c.WebsocketCompression = websocketCompression != "0"
+	}
+
+	websocketReadLimit, ok := syscall.Getenv("WEBSOCKET_READ_LIMIT")
+	if ok {
+		if limit, err := strconv.ParseInt(websocketReadLimit, 10, 64); err == nil && limit > 0 {
+			c.WebsocketReadLimit = limit
+		}
+	}
+
+	websocketGzipThreshold, ok := syscall.Getenv("WEBSOCKET_GZIP_THRESHOLD")
+	if ok {
+		if threshold, err := strconv.Atoi(websocketGzipThreshold); err == nil && threshold > 0 {
+			c.WebsocketGzipThreshold = threshold
+		}
+	}
+
+	websocketAllowedOrigins, ok := syscall.Getenv("WEBSOCKET_ALLOWED_ORIGINS")
+	if ok {
+		c.WebsocketAllowedOrigins = splitOrigins(websocketAllowedOrigins)
+	}
+
+	connectionIDLength, ok := syscall.Getenv("CONNECTION_ID_LENGTH")
+	if ok {
+		if length, err := strconv.Atoi(connectionIDLength); err == nil && validConnectionIDLength(length) {
+			c.ConnectionIDLength = length
+		}
+	}
+
+	connectionIDCounter, ok := syscall.Getenv("CONNECTION_ID_COUNTER")
+	if ok {
+		c.ConnectionIDCounter = connectionIDCounter != "0"
+	}
 }
 
 // ParseAppFlagConfig ...
@@ -96,6 +181,42 @@ func ParseAppFlagConfig(c *Config) {
 	if *flagProxyAddress != "" {
 		c.ProxyAddress = *flagProxyAddress
 	}
+
+	if *flagWebsocketCompression {
+		c.WebsocketCompression = *flagWebsocketCompression
+	}
+
+	if *flagWebsocketReadLimit > 0 {
+		c.WebsocketReadLimit = *flagWebsocketReadLimit
+	}
+
+	if *flagWebsocketGzipThreshold > 0 {
+		c.WebsocketGzipThreshold = *flagWebsocketGzipThreshold
+	}
+
+	if *flagWebsocketAllowedOrigins != "" {
+		c.WebsocketAllowedOrigins = splitOrigins(*flagWebsocketAllowedOrigins)
+	}
+
+	if *flagConnectionIDLength != 0 && validConnectionIDLength(*flagConnectionIDLength) {
+		c.ConnectionIDLength = *flagConnectionIDLength
+	}
+
+	if *flagConnectionIDCounter {
+		c.ConnectionIDCounter = *flagConnectionIDCounter
+	}
+}
+
+// splitOrigins parses a comma separated list of origins, ignoring the blank ones
+func splitOrigins(value string) []string {
+	origins := make([]string, 0)
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
+	return origins
 }
 
 // ParseNewRelicConfig ...
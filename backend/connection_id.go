@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	minConnectionIDLength = 8
+	maxConnectionIDLength = 32
+
+	// connectionIDCollisionOdds are the odds of two connections sharing a short ID over which a
+	// warning is logged
+	connectionIDCollisionOdds = 0.01
+)
+
+var (
+	// connectionCount is the number of connections opened since startup
+	connectionCount uint64
+
+	connectionIDCollisionWarned int32
+)
+
+// newShortID returns the ID a connection is logged with: the first ConnectionIDLength hex digits
+// of its UUID, followed by a sequence number unique to this process if ConnectionIDCounter is set.
+func newShortID(id uuid.UUID, c *Config) string {
+	digits := hex.EncodeToString(id[:])[:c.ConnectionIDLength]
+	count := atomic.AddUint64(&connectionCount, 1)
+
+	if c.ConnectionIDCounter {
+		return fmt.Sprintf("%s-%d", digits, count)
+	}
+
+	if count > likelyConnectionIDCollision(c.ConnectionIDLength) && atomic.CompareAndSwapInt32(&connectionIDCollisionWarned, 0, 1) {
+		logger.Warningf("%d connections were opened, their %d digit IDs may collide in the logs. Consider raising connection-id-length or enabling connection-id-counter", count, c.ConnectionIDLength)
+	}
+
+	return digits
+}
+
+// likelyConnectionIDCollision returns the number of connections after which two random IDs of
+// length hex digits have more than connectionIDCollisionOdds to be the same (birthday bound)
+func likelyConnectionIDCollision(length int) uint64 {
+	return uint64(math.Sqrt(2 * connectionIDCollisionOdds * math.Pow(16, float64(length))))
+}
+
+// validConnectionIDLength reports whether length digits of a UUID can be used as connection ID
+func validConnectionIDLength(length int) bool {
+	if length < minConnectionIDLength || length > maxConnectionIDLength {
+		logger.Warningf("Ignoring connection ID length %d, it must be between %d and %d", length, minConnectionIDLength, maxConnectionIDLength)
+		return false
+	}
+
+	return true
+}
@@ -28,6 +28,8 @@ func InitializeConsul(cfg *Config) (*ConsulHub, bool) {
 		channels := &ConsulRegionBroadcastChannels{}
 		channels.services = observer.NewProperty(&Action{})
 		channels.nodes = observer.NewProperty(&Action{})
+		channels.servicesHistory = newActionRing(cfg.ConsulReplayBuffer)
+		channels.nodesHistory = newActionRing(cfg.ConsulReplayBuffer)
 
 		regionChannels[region] = channels
 
@@ -38,7 +40,7 @@ func InitializeConsul(cfg *Config) (*ConsulHub, bool) {
 		}
 
 		logger.Infof("  -> Connecting to Consul")
-		nomad, nomadErr := NewConsulRegion(cfg, regionClient, channels)
+		nomad, nomadErr := NewConsulRegion(cfg, region, regionClient, channels)
 		if nomadErr != nil {
 			logger.Errorf("    -> Could not create Consul client: %s", nomadErr)
 			return nil, false
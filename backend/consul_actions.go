@@ -4,12 +4,68 @@ const (
 	fetchConsulRegions   = "FETCH_CONSUL_REGIONS"
 	fetchedConsulRegions = "FETCHED_CONSUL_REGIONS"
 
+	setConsulToken      = "SET_CONSUL_TOKEN"
+	setConsulAllowStale = "SET_CONSUL_ALLOW_STALE"
+	setConsulDatacenter = "SET_CONSUL_DATACENTER"
+	setConsulNamespace  = "SET_CONSUL_NAMESPACE"
+	clientHello         = "CLIENT_HELLO"
+
+	refreshConsulWatch = "REFRESH_CONSUL_WATCH"
+	unwatchAll         = "UNWATCH_ALL"
+
+	consulWatchStarted = "CONSUL_WATCH_STARTED"
+	consulWatchStopped = "CONSUL_WATCH_STOPPED"
+	watchHeartbeat     = "WATCH_HEARTBEAT"
+
+	connectionStats = "CONNECTION_STATS"
+	connectionIdle  = "CONNECTION_IDLE"
+	keepAlive       = "KEEP_ALIVE"
+
+	fetchWatchStatus   = "FETCH_WATCH_STATUS"
+	fetchedWatchStatus = "FETCHED_WATCH_STATUS"
+
+	fetchActiveWatches   = "FETCH_ACTIVE_WATCHES"
+	fetchedActiveWatches = "FETCHED_ACTIVE_WATCHES"
+
+	fetchConsulDatacenters   = "FETCH_CONSUL_DATACENTERS"
+	fetchedConsulDatacenters = "FETCHED_CONSUL_DATACENTERS"
+
+	fetchConsulRegionStatus   = "FETCH_CONSUL_REGION_STATUS"
+	fetchedConsulRegionStatus = "FETCHED_CONSUL_REGION_STATUS"
+
+	searchConsul               = "SEARCH_CONSUL"
+	fetchedConsulSearchResults = "FETCHED_CONSUL_SEARCH_RESULTS"
+
+	fetchConsulAgentSelf   = "FETCH_CONSUL_AGENT_SELF"
+	fetchedConsulAgentSelf = "FETCHED_CONSUL_AGENT_SELF"
+
 	fetchedConsulService  = "FETCHED_CONSUL_SERVICE"
 	fetchedConsulServices = "FETCHED_CONSUL_SERVICES"
 	unwatchConsulService  = "UNWATCH_CONSUL_SERVICE"
 	unwatchConsulServices = "UNWATCH_CONSUL_SERVICES"
 	watchConsulService    = "WATCH_CONSUL_SERVICE"
 	watchConsulServices   = "WATCH_CONSUL_SERVICES"
+	consulServiceGone     = "CONSUL_SERVICE_GONE"
+
+	watchConsulServicesMultiRegion   = "WATCH_CONSUL_SERVICES_MULTI_REGION"
+	unwatchConsulServicesMultiRegion = "UNWATCH_CONSUL_SERVICES_MULTI_REGION"
+	fetchedConsulServicesMultiRegion = "FETCHED_CONSUL_SERVICES_MULTI_REGION"
+
+	watchConsulServiceGroup   = "WATCH_CONSUL_SERVICE_GROUP"
+	unwatchConsulServiceGroup = "UNWATCH_CONSUL_SERVICE_GROUP"
+	fetchedConsulServiceGroup = "FETCHED_CONSUL_SERVICE_GROUP"
+
+	watchConsulServiceAllDC   = "WATCH_CONSUL_SERVICE_ALL_DC"
+	unwatchConsulServiceAllDC = "UNWATCH_CONSUL_SERVICE_ALL_DC"
+	fetchedConsulServiceAllDC = "FETCHED_CONSUL_SERVICE_ALL_DC"
+
+	watchConsulConnectServices   = "WATCH_CONSUL_CONNECT_SERVICES"
+	unwatchConsulConnectServices = "UNWATCH_CONSUL_CONNECT_SERVICES"
+	fetchedConsulConnectServices = "FETCHED_CONSUL_CONNECT_SERVICES"
+
+	fetchedConsulCatalogService = "FETCHED_CONSUL_CATALOG_SERVICE"
+	unwatchConsulCatalogService = "UNWATCH_CONSUL_CATALOG_SERVICE"
+	watchConsulCatalogService   = "WATCH_CONSUL_CATALOG_SERVICE"
 
 	fetchedConsulNode  = "FETCHED_CONSUL_NODE"
 	fetchedConsulNodes = "FETCHED_CONSUL_NODES"
@@ -17,10 +73,35 @@ const (
 	unwatchConsulNodes = "UNWATCH_CONSUL_NODES"
 	watchConsulNode    = "WATCH_CONSUL_NODE"
 	watchConsulNodes   = "WATCH_CONSUL_NODES"
+	consulNodeGone     = "CONSUL_NODE_GONE"
+
+	watchConsulNodeServices   = "WATCH_CONSUL_NODE_SERVICES"
+	unwatchConsulNodeServices = "UNWATCH_CONSUL_NODE_SERVICES"
+	fetchedConsulNodeServices = "FETCHED_CONSUL_NODE_SERVICES"
+
+	fetchedConsulChecksInState = "FETCHED_CONSUL_CHECKS_IN_STATE"
+	unwatchConsulChecksInState = "UNWATCH_CONSUL_CHECKS_IN_STATE"
+	watchConsulChecksInState   = "WATCH_CONSUL_CHECKS_IN_STATE"
 
+	fetchedConsulServiceChecks = "FETCHED_CONSUL_SERVICE_CHECKS"
+	unwatchConsulServiceChecks = "UNWATCH_CONSUL_SERVICE_CHECKS"
+	watchConsulServiceChecks   = "WATCH_CONSUL_SERVICE_CHECKS"
+
+	fetchedConsulIntentions = "FETCHED_CONSUL_INTENTIONS"
+	unwatchConsulIntentions = "UNWATCH_CONSUL_INTENTIONS"
+	watchConsulIntentions   = "WATCH_CONSUL_INTENTIONS"
+	createConsulIntention   = "CREATE_CONSUL_INTENTION"
+	deleteConsulIntention   = "DELETE_CONSUL_INTENTION"
+
+	registerConsulService        = "REGISTER_CONSUL_SERVICE"
 	dereigsterConsulService      = "DEREGISTER_CONSUL_SERVICE"
 	dereigsterConsulServiceCheck = "DEREGISTER_CONSUL_SERVICE_CHECK"
 
+	toggleConsulNodeMaintenance     = "TOGGLE_CONSUL_NODE_MAINTENANCE"
+	toggleConsulServiceMaintenance  = "TOGGLE_CONSUL_SERVICE_MAINTENANCE"
+	toggledConsulNodeMaintenance    = "TOGGLED_CONSUL_NODE_MAINTENANCE"
+	toggledConsulServiceMaintenance = "TOGGLED_CONSUL_SERVICE_MAINTENANCE"
+
 	deleteConsulKvFolder = "DELETE_CONSUL_KV_FOLDER"
 	fetchedConsulKVPath  = "FETCHED_CONSUL_KV_PATH"
 	fetchedConsulKVPair  = "FETCHED_CONSUL_KV_PAIR"
@@ -30,4 +111,68 @@ const (
 	watchConsulKVPath    = "WATCH_CONSUL_KV_PATH"
 	deleteConsulKvPair   = "DELETE_CONSUL_KV_PAIR"
 	clearConsulKvPair    = "CLEAR_CONSUL_KV_PAIR"
+
+	fetchedConsulKVPrefix = "FETCHED_CONSUL_KV_PREFIX"
+	unwatchConsulKVPrefix = "UNWATCH_CONSUL_KV_PREFIX"
+	watchConsulKVPrefix   = "WATCH_CONSUL_KV_PREFIX"
+
+	fetchedConsulLocks = "FETCHED_CONSUL_LOCKS"
+	unwatchConsulLocks = "UNWATCH_CONSUL_LOCKS"
+	watchConsulLocks   = "WATCH_CONSUL_LOCKS"
+
+	fetchedConsulKV = "FETCHED_CONSUL_KV"
+	unwatchConsulKV = "UNWATCH_CONSUL_KV"
+	watchConsulKV   = "WATCH_CONSUL_KV"
+	setConsulKV     = "SET_CONSUL_KV"
+	writtenConsulKV = "WRITTEN_CONSUL_KV"
+	deleteConsulKV  = "DELETE_CONSUL_KV"
+
+	deleteConsulKVTree  = "DELETE_CONSUL_KV_TREE"
+	deletedConsulKVTree = "DELETED_CONSUL_KV_TREE"
+
+	consulTxn          = "CONSUL_TXN"
+	completedConsulTxn = "COMPLETED_CONSUL_TXN"
+
+	fetchedConsulPreparedQueries     = "FETCHED_CONSUL_PREPARED_QUERIES"
+	unwatchConsulPreparedQueries     = "UNWATCH_CONSUL_PREPARED_QUERIES"
+	watchConsulPreparedQueries       = "WATCH_CONSUL_PREPARED_QUERIES"
+	executeConsulPreparedQuery       = "EXECUTE_CONSUL_PREPARED_QUERY"
+	fetchedConsulPreparedQueryResult = "FETCHED_CONSUL_PREPARED_QUERY_RESULT"
+
+	fetchedConsulSessions = "FETCHED_CONSUL_SESSIONS"
+	unwatchConsulSessions = "UNWATCH_CONSUL_SESSIONS"
+	watchConsulSessions   = "WATCH_CONSUL_SESSIONS"
+	destroyConsulSession  = "DESTROY_CONSUL_SESSION"
+
+	fetchedConsulMembers = "FETCHED_CONSUL_MEMBERS"
+	unwatchConsulMembers = "UNWATCH_CONSUL_MEMBERS"
+	watchConsulMembers   = "WATCH_CONSUL_MEMBERS"
+
+	fetchConsulNodeRTT       = "FETCH_CONSUL_NODE_RTT"
+	fetchedConsulNodeRTT     = "FETCHED_CONSUL_NODE_RTT"
+	fetchedConsulCoordinates = "FETCHED_CONSUL_COORDINATES"
+	unwatchConsulCoordinates = "UNWATCH_CONSUL_COORDINATES"
+	watchConsulCoordinates   = "WATCH_CONSUL_COORDINATES"
+
+	fetchedConsulEvents = "FETCHED_CONSUL_EVENTS"
+	unwatchConsulEvents = "UNWATCH_CONSUL_EVENTS"
+	watchConsulEvents   = "WATCH_CONSUL_EVENTS"
+	fireConsulEvent     = "FIRE_CONSUL_EVENT"
+
+	fetchedConsulACLTokens = "FETCHED_CONSUL_ACL_TOKENS"
+	unwatchConsulACLTokens = "UNWATCH_CONSUL_ACL_TOKENS"
+	watchConsulACLTokens   = "WATCH_CONSUL_ACL_TOKENS"
+	watchConsulACLPolicies = "WATCH_CONSUL_ACL_POLICIES"
+	createConsulACLToken   = "CREATE_CONSUL_ACL_TOKEN"
+	deleteConsulACLToken   = "DELETE_CONSUL_ACL_TOKEN"
+	readConsulACLToken     = "READ_CONSUL_ACL_TOKEN"
+	fetchedConsulACLToken  = "FETCHED_CONSUL_ACL_TOKEN"
+
+	fetchedConsulRaftConfiguration = "FETCHED_CONSUL_RAFT_CONFIGURATION"
+	unwatchConsulRaftConfiguration = "UNWATCH_CONSUL_RAFT_CONFIGURATION"
+	watchConsulRaftConfiguration   = "WATCH_CONSUL_RAFT_CONFIGURATION"
+
+	fetchedConsulHealthSummary = "FETCHED_CONSUL_HEALTH_SUMMARY"
+	unwatchConsulHealthSummary = "UNWATCH_CONSUL_HEALTH_SUMMARY"
+	watchConsulHealthSummary   = "WATCH_CONSUL_HEALTH_SUMMARY"
 )
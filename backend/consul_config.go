@@ -4,8 +4,12 @@ import (
 	"flag"
 	"strconv"
 	"syscall"
+	"time"
 )
 
+// maxConsulWaitTime is the longest blocking query Consul accepts
+const maxConsulWaitTime = 10 * time.Minute
+
 var (
 	flagConsulEnable = flag.Bool("consul-enable", false, "Whether Consul engine should be started. "+
 		"Overrides the CONSUL_ENABLE environment variable if set. "+flagDefault(strconv.FormatBool(defaultConfig.ConsulEnable)))
@@ -15,8 +19,51 @@ var (
 
 	flagConsulAddress = flag.String("consul-address", "", "The address of the Consul server. "+
 		"Overrides the CONSUL_ADDR environment variable if set. "+flagDefault(defaultConfig.ConsulAddress))
+
+	flagConsulACLToken = flag.String("consul-acl-token", "", "The ACL token to use when talking to Consul. "+
+		"Overrides the CONSUL_ACL_TOKEN environment variable if set. "+flagDefault(defaultConfig.ConsulACLToken))
+
+	flagConsulCACert = flag.String("consul-ca-cert", "", "Path to the Consul TLS CA Cert File. "+
+		"Overrides the CONSUL_CACERT environment variable if set. "+flagDefault(defaultConfig.ConsulCACert))
+
+	flagConsulClientCert = flag.String("consul-client-cert", "", "Path to the Consul Client Cert File. "+
+		"Overrides the CONSUL_CLIENT_CERT environment variable if set. "+flagDefault(defaultConfig.ConsulClientCert))
+
+	flagConsulClientKey = flag.String("consul-client-key", "", "Path to the Consul Client Key File. "+
+		"Overrides the CONSUL_CLIENT_KEY environment variable if set. "+flagDefault(defaultConfig.ConsulClientKey))
+
+	flagConsulSkipVerify = flag.Bool("consul-skip-verify", false, "Whether Hashi-UI should skip Consul TLS verification, not recommended. "+
+		"Overrides the CONSUL_SKIP_VERIFY environment variable if set. "+flagDefault(strconv.FormatBool(defaultConfig.ConsulSkipVerify)))
+
+	flagConsulSendBuffer = flag.Int("consul-send-buffer", 0, "The number of actions queued per websocket connection before slow clients are dropped. "+
+		"Overrides the CONSUL_SEND_BUFFER environment variable if set. "+flagDefault(strconv.Itoa(defaultConfig.ConsulSendBuffer)))
+
+	flagConsulMaxWatches = flag.Int("consul-max-watches", 0, "The maximum number of watches a single websocket connection may run. "+
+		"Overrides the CONSUL_MAX_WATCHES environment variable if set. "+flagDefault(strconv.Itoa(defaultConfig.ConsulMaxWatches)))
+
+	flagConsulWaitTime = flag.Duration("consul-wait-time", 0, "How long blocking queries to Consul wait for changes, at most 10m. "+
+		"Overrides the CONSUL_WAIT_TIME environment variable if set. "+flagDefault(defaultConfig.ConsulWaitTime.String()))
+
+	flagConsulIdleTimeout = flag.Duration("consul-idle-timeout", 0, "How long a websocket connection may go without any message from the browser before it is closed, 0 never closes it. "+
+		"Overrides the CONSUL_IDLE_TIMEOUT environment variable if set. "+flagDefault(defaultConfig.ConsulIdleTimeout.String()))
+
+	flagConsulRequestTimeout = flag.Duration("consul-request-timeout", 0, "How long one-shot Consul requests (not the blocking queries of watches) are waited for. "+
+		"Overrides the CONSUL_REQUEST_TIMEOUT environment variable if set. "+flagDefault(defaultConfig.ConsulRequestTimeout.String()))
+
+	flagConsulReplayBuffer = flag.Int("consul-replay-buffer", 0, "The number of recent services and nodes updates replayed to a newly subscribing websocket connection, 0 only sends the latest. "+
+		"Overrides the CONSUL_REPLAY_BUFFER environment variable if set. "+flagDefault(strconv.Itoa(defaultConfig.ConsulReplayBuffer)))
 )
 
+// validConsulWaitTime reports whether waitTime is a blocking query wait time Consul accepts
+func validConsulWaitTime(waitTime time.Duration) bool {
+	if waitTime <= 0 || waitTime > maxConsulWaitTime {
+		logger.Warningf("Ignoring Consul wait time %s, it must be between 0 and %s", waitTime, maxConsulWaitTime)
+		return false
+	}
+
+	return true
+}
+
 // ParseConsulEnvConfig ...
 func ParseConsulEnvConfig(c *Config) {
 	consulEnable, ok := syscall.Getenv("CONSUL_ENABLE")
@@ -33,6 +80,73 @@ func ParseConsulEnvConfig(c *Config) {
 	if ok {
 		c.ConsulAddress = consulAddress
 	}
+
+	consulACLToken, ok := syscall.Getenv("CONSUL_ACL_TOKEN")
+	if ok {
+		c.ConsulACLToken = consulACLToken
+	}
+
+	consulCACert, ok := syscall.Getenv("CONSUL_CACERT")
+	if ok {
+		c.ConsulCACert = consulCACert
+	}
+
+	consulClientCert, ok := syscall.Getenv("CONSUL_CLIENT_CERT")
+	if ok {
+		c.ConsulClientCert = consulClientCert
+	}
+
+	consulClientKey, ok := syscall.Getenv("CONSUL_CLIENT_KEY")
+	if ok {
+		c.ConsulClientKey = consulClientKey
+	}
+
+	consulSkipVerify, ok := syscall.Getenv("CONSUL_SKIP_VERIFY")
+	if ok {
+		c.ConsulSkipVerify = consulSkipVerify != "0"
+	}
+
+	consulSendBuffer, ok := syscall.Getenv("CONSUL_SEND_BUFFER")
+	if ok {
+		if size, err := strconv.Atoi(consulSendBuffer); err == nil && size > 0 {
+			c.ConsulSendBuffer = size
+		}
+	}
+
+	consulMaxWatches, ok := syscall.Getenv("CONSUL_MAX_WATCHES")
+	if ok {
+		if limit, err := strconv.Atoi(consulMaxWatches); err == nil && limit > 0 {
+			c.ConsulMaxWatches = limit
+		}
+	}
+
+	consulWaitTime, ok := syscall.Getenv("CONSUL_WAIT_TIME")
+	if ok {
+		if waitTime, err := time.ParseDuration(consulWaitTime); err == nil && validConsulWaitTime(waitTime) {
+			c.ConsulWaitTime = waitTime
+		}
+	}
+
+	consulIdleTimeout, ok := syscall.Getenv("CONSUL_IDLE_TIMEOUT")
+	if ok {
+		if timeout, err := time.ParseDuration(consulIdleTimeout); err == nil && timeout >= 0 {
+			c.ConsulIdleTimeout = timeout
+		}
+	}
+
+	consulRequestTimeout, ok := syscall.Getenv("CONSUL_REQUEST_TIMEOUT")
+	if ok {
+		if timeout, err := time.ParseDuration(consulRequestTimeout); err == nil && timeout > 0 {
+			c.ConsulRequestTimeout = timeout
+		}
+	}
+
+	consulReplayBuffer, ok := syscall.Getenv("CONSUL_REPLAY_BUFFER")
+	if ok {
+		if size, err := strconv.Atoi(consulReplayBuffer); err == nil && size >= 0 {
+			c.ConsulReplayBuffer = size
+		}
+	}
 }
 
 // ParseConsulFlagConfig ...
@@ -48,4 +162,48 @@ func ParseConsulFlagConfig(c *Config) {
 	if *flagConsulAddress != "" {
 		c.ConsulAddress = *flagConsulAddress
 	}
+
+	if *flagConsulACLToken != "" {
+		c.ConsulACLToken = *flagConsulACLToken
+	}
+
+	if *flagConsulCACert != "" {
+		c.ConsulCACert = *flagConsulCACert
+	}
+
+	if *flagConsulClientCert != "" {
+		c.ConsulClientCert = *flagConsulClientCert
+	}
+
+	if *flagConsulClientKey != "" {
+		c.ConsulClientKey = *flagConsulClientKey
+	}
+
+	if *flagConsulSkipVerify {
+		c.ConsulSkipVerify = *flagConsulSkipVerify
+	}
+
+	if *flagConsulSendBuffer > 0 {
+		c.ConsulSendBuffer = *flagConsulSendBuffer
+	}
+
+	if *flagConsulMaxWatches > 0 {
+		c.ConsulMaxWatches = *flagConsulMaxWatches
+	}
+
+	if *flagConsulWaitTime != 0 && validConsulWaitTime(*flagConsulWaitTime) {
+		c.ConsulWaitTime = *flagConsulWaitTime
+	}
+
+	if *flagConsulIdleTimeout > 0 {
+		c.ConsulIdleTimeout = *flagConsulIdleTimeout
+	}
+
+	if *flagConsulRequestTimeout > 0 {
+		c.ConsulRequestTimeout = *flagConsulRequestTimeout
+	}
+
+	if *flagConsulReplayBuffer > 0 {
+		c.ConsulReplayBuffer = *flagConsulReplayBuffer
+	}
 }
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -18,79 +27,729 @@ import (
 type ConsulConnection struct {
 	ID                uuid.UUID
 	shortID           string
+	log               fieldsLogger
 	socket            *websocket.Conn
 	receive           chan *Action
 	send              chan *Action
-	destroyCh         chan struct{}
+	ctx               context.Context
+	cancel            context.CancelFunc
 	watches           *set.Set
+	watchCtx          context.Context
+	watchCancel       context.CancelFunc
+	watchOwners       map[string]context.Context
 	hub               *ConsulHub
 	region            *ConsulRegion
 	broadcastChannels *ConsulRegionBroadcastChannels
+	lock              sync.RWMutex
+	token             string
+	tokenChanged      chan struct{}
+	allowStale        bool
+	datacenter        string
+	namespace         string
+	serviceTag        string
+	nodesWithHealth   bool
+	nodesMeta         map[string]string
+	runningWatches    int32
+	watchStatus       map[string]*ConsulWatchStatus
+
+	// the clients of the blocking queries and of the one-shot requests of the connection, scoped
+	// to the namespace set with SET_CONSUL_NAMESPACE. Their requests are aborted with the
+	// connection, see requestContext.
+	consulClient        *api.Client
+	consulRequestClient *api.Client
+
+	// the latest services and nodes of the remote datacenter set with SET_CONSUL_DATACENTER (or
+	// of the namespace set with SET_CONSUL_NAMESPACE), which the region broadcasts don't cover
+	remoteServices *ConsulInternalServices
+	remoteNodes    *ConsulInternalNodes
+
+	// lastActivity is when the last message was received from the client
+	lastActivity time.Time
+
+	// capabilities announced by the client in CLIENT_HELLO
+	batchFrames      bool
+	batchWindow      time.Duration
+	writeCompression bool
+	gzipPayloads     bool
+	queryMeta        bool
+
+	// MinUpdateInterval is the shortest interval allowed between two updates
+	// sent by a single watch. Blocking queries remain the primary pacing, this
+	// only kicks in when a busy cluster changes faster than that.
+	MinUpdateInterval time.Duration
+
+	// MembersPollInterval is how often the agent members are polled, since
+	// the members endpoint doesn't support blocking queries.
+	MembersPollInterval time.Duration
+
+	// CoordinatesPollInterval is how often the node coordinates are polled.
+	// Coordinates change all the time, so blocking on them would never settle.
+	CoordinatesPollInterval time.Duration
+
+	// RaftPollInterval is how often the raft configuration is polled, the
+	// operator endpoint doesn't support blocking queries.
+	RaftPollInterval time.Duration
 }
 
+const (
+	// defaultMinUpdateInterval is the default ConsulConnection.MinUpdateInterval
+	defaultMinUpdateInterval = 1 * time.Second
+
+	// defaultMembersPollInterval is the default ConsulConnection.MembersPollInterval
+	defaultMembersPollInterval = 10 * time.Second
+
+	// defaultCoordinatesPollInterval is the default ConsulConnection.CoordinatesPollInterval
+	defaultCoordinatesPollInterval = 10 * time.Second
+
+	// defaultRaftPollInterval is the default ConsulConnection.RaftPollInterval
+	defaultRaftPollInterval = 10 * time.Second
+
+	// minBlockingQueryTime is how long a blocking query returning an unchanged index must have
+	// blocked, below that the watch sleeps idleWatchSleep before the next query
+	minBlockingQueryTime = 1 * time.Second
+	idleWatchSleep       = 5 * time.Second
+
+	// consulRegionStatusTimeout is how long a region gets to answer FETCH_CONSUL_REGION_STATUS
+	// before it is reported unreachable
+	consulRegionStatusTimeout = 3 * time.Second
+
+	// connectionStatsInterval is how often a connection is sent its CONNECTION_STATS
+	connectionStatsInterval = 15 * time.Second
+
+	// idleGracePeriod is how long a connection warned with CONNECTION_IDLE has to send any
+	// message before it is closed
+	idleGracePeriod = 1 * time.Minute
+
+	// consulSendTimeout is how long sendAction waits on a full send buffer
+	// before giving up on the client
+	consulSendTimeout = 10 * time.Second
+
+	// consulLagRetryInterval is how often a broadcast watch retries delivering the latest
+	// update to a connection whose send buffer was full
+	consulLagRetryInterval = 500 * time.Millisecond
+
+	// maxBatchWindow and maxThrottleInterval bound the CLIENT_HELLO settings
+	maxBatchWindow      = 5 * time.Second
+	maxThrottleInterval = 60 * time.Second
+
+	// maxConsulServiceGroup bounds the number of services of a service group watch, and of
+	// datacenters of an all datacenters watch, which run a blocking query for each
+	maxConsulServiceGroup = 50
+
+	// consulSearchLimit is the number of results SEARCH_CONSUL returns per category
+	consulSearchLimit = 20
+)
+
 // NewConsulConnection creates a new connection.
-func NewConsulConnection(hub *ConsulHub, socket *websocket.Conn, consulRegion *ConsulRegion, channels *ConsulRegionBroadcastChannels) *ConsulConnection {
+//
+// sendBufferSize is the number of actions that may be queued for the websocket
+// before watchers start blocking, see sendAction.
+func NewConsulConnection(hub *ConsulHub, socket *websocket.Conn, consulRegion *ConsulRegion, channels *ConsulRegionBroadcastChannels, sendBufferSize int) *ConsulConnection {
 	connectionID := uuid.NewV4()
+	ctx, cancel := context.WithCancel(context.Background())
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	shortID := newShortID(connectionID, consulRegion.Config)
+
+	c := &ConsulConnection{
+		ID:                      connectionID,
+		shortID:                 shortID,
+		log:                     newFieldsLogger("connection", shortID).With("region", consulRegion.Datacenter),
+		watches:                 set.New(),
+		watchStatus:             make(map[string]*ConsulWatchStatus),
+		tokenChanged:            make(chan struct{}),
+		hub:                     hub,
+		socket:                  socket,
+		receive:                 make(chan *Action),
+		send:                    make(chan *Action, sendBufferSize),
+		ctx:                     ctx,
+		watchCtx:                watchCtx,
+		watchCancel:             watchCancel,
+		watchOwners:             make(map[string]context.Context),
+		cancel:                  cancel,
+		region:                  consulRegion,
+		broadcastChannels:       channels,
+		MinUpdateInterval:       defaultMinUpdateInterval,
+		MembersPollInterval:     defaultMembersPollInterval,
+		CoordinatesPollInterval: defaultCoordinatesPollInterval,
+		RaftPollInterval:        defaultRaftPollInterval,
+		batchFrames:             true,
+		writeCompression:        true,
+		lastActivity:            time.Now(),
+	}
+
+	// without clients of its own, the connection falls back to the region clients, whose
+	// requests can't be aborted
+	client, requestClient, err := c.newClients("")
+	if err != nil {
+		c.Errorf("Unable to create the Consul clients of the connection: %s", err)
+	}
+	c.consulClient, c.consulRequestClient = client, requestClient
+
+	return c
+}
+
+// clientHello applies the capabilities announced by the client: whether it accepts batched
+// frames (and how long to wait for a batch to fill), compressed frames, and the shortest
+// interval between two updates of a watch. Out of range values are ignored.
+func (c *ConsulConnection) clientHello(action Action) {
+	params, ok := action.Payload.(*ConsulClientHelloPayload)
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if params.Batch != nil {
+		c.batchFrames = *params.Batch
+	}
+
+	if params.BatchWindow != nil {
+		if window := time.Duration(*params.BatchWindow) * time.Millisecond; window >= 0 && window <= maxBatchWindow {
+			c.batchWindow = window
+		} else {
+			c.Warningf("Ignoring batch window of %dms", *params.BatchWindow)
+		}
+	}
+
+	if params.Compression != nil {
+		c.writeCompression = *params.Compression
+	}
+
+	if params.GzipPayloads != nil {
+		c.gzipPayloads = *params.GzipPayloads
+	}
+
+	if params.QueryMeta != nil {
+		c.queryMeta = *params.QueryMeta
+	}
+
+	// the client tells how far it got on its previous connection, as a clue for the logs: the
+	// actions of this connection are numbered from 1 again
+	if params.LastSeq != nil && *params.LastSeq > 0 {
+		c.Infof("Client reconnected after receiving %d actions on its previous connection", *params.LastSeq)
+	}
+
+	if params.ThrottleInterval != nil {
+		if interval := time.Duration(*params.ThrottleInterval) * time.Millisecond; interval >= 0 && interval <= maxThrottleInterval {
+			c.MinUpdateInterval = interval
+		} else {
+			c.Warningf("Ignoring throttle interval of %dms", *params.ThrottleInterval)
+		}
+	}
+
+	c.Infof("Client hello: batch=%t (window %s), compression=%t, gzip=%t, queryMeta=%t, throttle=%s", c.batchFrames, c.batchWindow, c.writeCompression, c.gzipPayloads, c.queryMeta, c.MinUpdateInterval)
+}
 
-	return &ConsulConnection{
-		ID:                connectionID,
-		shortID:           fmt.Sprintf("%s", connectionID)[0:8],
-		watches:           set.New(),
-		hub:               hub,
-		socket:            socket,
-		receive:           make(chan *Action),
-		send:              make(chan *Action),
-		destroyCh:         make(chan struct{}),
-		region:            consulRegion,
-		broadcastChannels: channels,
+// throttle blocks until at least MinUpdateInterval has passed since last, or ctx is done,
+// and records the current time in last. Updates arriving slower than
+// MinUpdateInterval are never delayed.
+func (c *ConsulConnection) throttle(ctx context.Context, last *time.Time) {
+	c.lock.RLock()
+	interval := c.MinUpdateInterval
+	c.lock.RUnlock()
+
+	if elapsed := time.Since(*last); elapsed < interval {
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval - elapsed):
+		}
 	}
+
+	*last = time.Now()
 }
 
-// Warningf is a stupid wrapper for logger.Warningf
+// Warningf is a stupid wrapper for logger.Warningf, adding the connection fields
 func (c *ConsulConnection) Warningf(format string, args ...interface{}) {
-	message := fmt.Sprintf("[%s] ", c.shortID) + format
-	logger.Warningf(message, args...)
+	c.log.Warningf(format, args...)
 }
 
-// Errorf is a stupid wrapper for logger.Errorf
+// Errorf is a stupid wrapper for logger.Errorf, adding the connection fields
 func (c *ConsulConnection) Errorf(format string, args ...interface{}) {
-	message := fmt.Sprintf("[%s] ", c.shortID) + format
-	logger.Errorf(message, args...)
+	c.log.Errorf(format, args...)
 }
 
-// Infof is a stupid wrapper for logger.Infof
+// Infof is a stupid wrapper for logger.Infof, adding the connection fields
 func (c *ConsulConnection) Infof(format string, args ...interface{}) {
-	message := fmt.Sprintf("[%s] ", c.shortID) + format
-	logger.Infof(message, args...)
+	c.log.Infof(format, args...)
 }
 
-// Debugf is a stupid wrapper for logger.Debugf
+// Debugf is a stupid wrapper for logger.Debugf, adding the connection fields
 func (c *ConsulConnection) Debugf(format string, args ...interface{}) {
-	message := fmt.Sprintf("[%s] ", c.shortID) + format
-	logger.Debugf(message, args...)
+	c.log.Debugf(format, args...)
+}
+
+// sendAction queues an action for the websocket. If the client doesn't keep up
+// and the send buffer stays full for consulSendTimeout, the socket is closed so
+// the connection tears down instead of blocking the watcher forever.
+func (c *ConsulConnection) sendAction(action *Action) {
+	select {
+	case c.send <- action:
+		atomic.AddUint64(&consulMetrics.actionsSent, 1)
+	case <-c.ctx.Done():
+	case <-time.After(consulSendTimeout):
+		c.Errorf("Send buffer full for %s, closing slow connection", consulSendTimeout)
+		c.socket.Close()
+	}
+}
+
+// reply sends response to the write action request, echoing its request ID so the client can
+// tell which of its writes the notification answers
+func (c *ConsulConnection) reply(request Action, response *Action) {
+	response.RequestID = request.RequestID
+	c.sendAction(response)
+}
+
+// trySendAction queues action on the send buffer without waiting, returning false when the
+// buffer is full so broadcast watches can skip the connection instead of blocking on it
+func (c *ConsulConnection) trySendAction(action *Action) bool {
+	select {
+	case c.send <- action:
+		atomic.AddUint64(&consulMetrics.actionsSent, 1)
+		return true
+	case <-c.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// retryWatch records a failed watch query and waits for the next backoff delay, or until the
+// watch running under ctx is stopped. The client is
+// notified on the first failure of a series only, not on every retry. Permission errors won't
+// go away by retrying, so the watch is paused instead until the connection sets another ACL token.
+func (c *ConsulConnection) retryWatch(ctx context.Context, key string, err error, retry *backoff) {
+	atomic.AddUint64(&consulMetrics.watchErrors, 1)
+	c.recordWatchError(key, err)
+
+	if isPermissionDenied(err) {
+		c.log.With("watch", key).Warningf("Permission denied watching %s, pausing until the ACL token changes", key)
+		c.sendAction(&Action{Type: errorNotification, Payload: &ErrorNotification{
+			Message:  fmt.Sprintf("Permission denied watching %s, the watch is paused until a new Consul ACL token is set: %s", key, err),
+			WatchKey: key,
+			Severity: severityError,
+		}})
+
+		c.waitForTokenChange(ctx, key)
+		retry.Reset()
+		return
+	}
+
+	if retry.Failures() == 0 {
+		c.notifyWatchError(key, err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(retry.Next()):
+	}
+}
+
+// waitForTokenChange blocks until the connection ACL token changes, the watch running under ctx
+// is stopped or the client unsubscribes from the watch key
+func (c *ConsulConnection) waitForTokenChange(ctx context.Context, key string) {
+	c.lock.RLock()
+	changed := c.tokenChanged
+	c.lock.RUnlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-changed:
+			c.log.With("watch", key).Infof("ACL token changed, resuming %s", key)
+			return
+
+		case <-time.After(watchRetryMax):
+			if !c.watches.Has(key) {
+				return
+			}
+		}
+	}
+}
+
+// notifyWatchError tells the client a watch is failing. Permission errors are reported with the
+// error severity since they won't go away on retry, anything else as a warning.
+func (c *ConsulConnection) notifyWatchError(key string, err error) {
+	notification := &ErrorNotification{
+		Message:  fmt.Sprintf("Unable to watch %s: %s", key, err),
+		WatchKey: key,
+		Severity: severityWarning,
+	}
+
+	if isPermissionDenied(err) {
+		notification.Message = fmt.Sprintf("Permission denied watching %s, check your Consul ACL token: %s", key, err)
+		notification.Severity = severityError
+	}
+
+	c.sendAction(&Action{Type: errorNotification, Payload: notification})
+}
+
+// watchBlockingQuery runs query in a blocking loop on behalf of the watch key, starting at
+// sinceIndex. Whenever the index advanced and the payload changed, emit turns the payload into
+// the action sent to the client, its Index and Meta are filled in here. Subscription
+// bookkeeping, retries, index resets and throttling are taken care of, so single object
+// watches only have to provide the query and the action.
+func (c *ConsulConnection) watchBlockingQuery(key string, sinceIndex uint64, query func(*api.QueryOptions) (interface{}, *api.QueryMeta, error), emit func(payload interface{}) *Action) {
+	c.watchCoalescedQuery(key, sinceIndex, 0, query, emit)
+}
+
+// watchCoalescedQuery is watchBlockingQuery with a coalescing window: a change coming within
+// window of the previous update waits for the end of the window, and the state at that time is
+// sent instead. Flapping data then makes a single update per window, or none when it flapped
+// back to what the client already has.
+func (c *ConsulConnection) watchCoalescedQuery(key string, sinceIndex uint64, window time.Duration, query func(*api.QueryOptions) (interface{}, *api.QueryMeta, error), emit func(payload interface{}) *Action) {
+	log := c.log.With("watch", key)
+
+	if c.watches.Has(key) {
+		log.Warningf("Connection is already subscribed to %s", key)
+		c.sendWatchEvent(consulWatchStarted, key, true)
+		return
+	}
+
+	ctx := c.watchContext()
+	defer c.stopWatch(ctx, key)
+	c.addWatch(ctx, key)
+	c.sendWatchEvent(consulWatchStarted, key, false)
+
+	log.Infof("Started watching %s", key)
+
+	q := c.queryOptions(sinceIndex, 0)
+	retry := newBackoff(watchRetryMin, watchRetryMax)
+	var lastUpdate time.Time
+	var lastSent time.Time
+	var lastChecksum uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		default:
+			started := time.Now()
+			payload, meta, err := query(q)
+			if err != nil {
+				log.Errorf("connection: unable to fetch %s: %s", key, err)
+				c.retryWatch(ctx, key, err, retry)
+				continue
+			}
+			retry.Reset()
+
+			if !c.watching(ctx, key) {
+				return
+			}
+
+			remoteWaitIndex := meta.LastIndex
+			c.recordWatchSuccess(key, remoteWaitIndex)
+			localWaitIndex := q.WaitIndex
+
+			// the index went backwards (e.g. after a Consul server restart), start over
+			if remoteWaitIndex < localWaitIndex {
+				log.Warningf("Index for %s went backwards (%d < %d), resetting", key, remoteWaitIndex, localWaitIndex)
+				q = c.queryOptions(1, 0)
+				continue
+			}
+
+			// only broadcast if the LastIndex has changed. A query returning the same index without
+			// blocking would otherwise make an idle watch spin, so back off before asking again.
+			if remoteWaitIndex == localWaitIndex {
+				log.Debugf("Index for %s is unchanged (%d == %d)", key, localWaitIndex, remoteWaitIndex)
+
+				if !c.waitIfIdle(ctx, started) {
+					return
+				}
+				continue
+			}
+
+			q = c.queryOptions(remoteWaitIndex, c.region.Config.ConsulWaitTime)
+
+			sentChecksum := lastChecksum
+			if !c.payloadChanged(payload, &lastChecksum) {
+				log.Debugf("Payload for %s is unchanged at index %d, not sending", key, remoteWaitIndex)
+				continue
+			}
+
+			// within the coalescing window, wait for its end and send the state at that time instead
+			if wait := window - time.Since(lastSent); window > 0 && wait > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+
+				latest, latestMeta, err := query(c.queryOptions(0, 0))
+				if err == nil {
+					payload, meta, remoteWaitIndex = latest, latestMeta, latestMeta.LastIndex
+					q = c.queryOptions(remoteWaitIndex, c.region.Config.ConsulWaitTime)
+
+					// the data may have flapped back to what the client already has
+					lastChecksum = sentChecksum
+					if !c.payloadChanged(payload, &lastChecksum) {
+						continue
+					}
+				}
+			}
+
+			action := emit(payload)
+			action.Index = remoteWaitIndex
+			action.Meta = c.actionMeta(meta)
+			c.sendWatchAction(key, action)
+			lastSent = time.Now()
+
+			// don't refresh data more frequent than MinUpdateInterval, since busy clusters update every second or faster
+			c.throttle(ctx, &lastUpdate)
+		}
+	}
+}
+
+// waitIfIdle sleeps idleWatchSleep after a query that returned an unchanged index without
+// blocking for minBlockingQueryTime, so an agent answering right away doesn't make the watch
+// spin. It returns false when the watch running under ctx was stopped in the meantime.
+func (c *ConsulConnection) waitIfIdle(ctx context.Context, started time.Time) bool {
+	if time.Since(started) >= minBlockingQueryTime {
+		return true
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(idleWatchSleep):
+		return true
+	}
+}
+
+// watchContext returns the context watches run under. It is done when the connection closes, or
+// when UNWATCH_ALL stops all the watches.
+func (c *ConsulConnection) watchContext() context.Context {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.watchCtx
+}
+
+// addWatch subscribes to the watch key on behalf of the watch running under ctx
+func (c *ConsulConnection) addWatch(ctx context.Context, key string) {
+	c.lock.Lock()
+	c.watchOwners[key] = ctx
+	c.lock.Unlock()
+
+	c.watches.Add(key)
+}
+
+// watching reports whether the watch running under ctx should go on with the watch key, that is
+// the key is still subscribed to and the watch wasn't stopped by UNWATCH_ALL in the meantime
+func (c *ConsulConnection) watching(ctx context.Context, key string) bool {
+	return ctx.Err() == nil && c.watches.Has(key)
+}
+
+// stopWatch unsubscribes from the watch key when the watch running under ctx exits. A watch
+// stopped by UNWATCH_ALL no longer owns its key, which the client may have subscribed to again.
+func (c *ConsulConnection) stopWatch(ctx context.Context, key string) {
+	c.log.With("watch", key).Infof("Stopped watching %s", key)
+
+	c.lock.Lock()
+	owned := c.watchOwners[key] == ctx
+	if owned {
+		delete(c.watchOwners, key)
+		c.watches.Remove(key)
+	}
+	c.lock.Unlock()
+
+	if owned {
+		c.sendWatchEvent(consulWatchStopped, key, false)
+	}
+}
+
+// unwatchAll stops all the watches of the connection, without closing it. The running watches
+// are cancelled and lose their keys at once, so new watches can be started right away even if
+// the old ones are still winding down.
+func (c *ConsulConnection) unwatchAll() {
+	c.lock.Lock()
+	c.watchCancel()
+	c.watchCtx, c.watchCancel = context.WithCancel(c.ctx)
+	c.watchOwners = make(map[string]context.Context)
+	keys := set.StringSlice(c.watches)
+	c.watches.Clear()
+	c.lock.Unlock()
+
+	c.Infof("Stopped all %d watches", len(keys))
+
+	for _, key := range keys {
+		c.sendWatchEvent(consulWatchStopped, key, false)
+	}
+}
+
+// sendWatchEvent tells the client a watch was started (or already running) or stopped
+func (c *ConsulConnection) sendWatchEvent(eventType, key string, duplicate bool) {
+	c.sendAction(&Action{Type: eventType, Payload: &ConsulWatchEvent{WatchKey: key, Duplicate: duplicate}})
+}
+
+// updateWatchStatus applies update to the status of the watch key, creating it if needed
+func (c *ConsulConnection) updateWatchStatus(key string, update func(status *ConsulWatchStatus)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	status, ok := c.watchStatus[key]
+	if !ok {
+		status = &ConsulWatchStatus{WatchKey: key}
+		c.watchStatus[key] = status
+	}
+
+	update(status)
+}
+
+// recordWatchSuccess records a successful query of the watch key at index, and tells the client
+// with a WATCH_HEARTBEAT. Blocking queries return at least every ConsulWaitTime, so the client
+// hears from a healthy watch even when nothing changes. Heartbeats are dropped rather than
+// waited for when the send buffer is full.
+func (c *ConsulConnection) recordWatchSuccess(key string, index uint64) {
+	now := time.Now().UTC()
+	c.updateWatchStatus(key, func(status *ConsulWatchStatus) {
+		status.LastIndex = index
+		status.LastSuccess = now
+	})
+
+	c.trySendAction(&Action{Type: watchHeartbeat, Payload: &WatchHeartbeat{WatchKey: key, Index: index, Time: now}, Index: index})
+}
+
+// recordWatchError records a failed query of the watch key
+func (c *ConsulConnection) recordWatchError(key string, err error) {
+	c.updateWatchStatus(key, func(status *ConsulWatchStatus) {
+		status.LastError = err.Error()
+		status.LastErrorTime = time.Now().UTC()
+	})
+}
+
+// recordWatchBroadcast records an update sent to the client by the watch key, in its status and
+// in the metrics of its action type
+func (c *ConsulConnection) recordWatchBroadcast(key string, action *Action) {
+	c.updateWatchStatus(key, func(status *ConsulWatchStatus) {
+		status.LastBroadcast = time.Now().UTC()
+	})
+
+	consulMetrics.recordBroadcast(action.Type, action.Index)
+}
+
+// sendWatchAction sends an update of the watch key to the client
+func (c *ConsulConnection) sendWatchAction(key string, action *Action) {
+	c.recordWatchBroadcast(key, action)
+	c.sendAction(action)
+}
+
+// fetchWatchStatus sends the status of every running watch of the connection, sorted by key.
+// The status of watches that were stopped since is dropped.
+func (c *ConsulConnection) fetchWatchStatus() {
+	c.lock.Lock()
+	statuses := make([]ConsulWatchStatus, 0, len(c.watchStatus))
+	for key, status := range c.watchStatus {
+		if !c.watches.Has(key) {
+			delete(c.watchStatus, key)
+			continue
+		}
+
+		statuses = append(statuses, *status)
+	}
+	c.lock.Unlock()
+
+	sort.Sort(ConsulWatchStatusSorter(statuses))
+
+	c.sendAction(&Action{Type: fetchedWatchStatus, Payload: statuses})
+}
+
+// ConsulWatchStatusSorter sorts watch statuses by watch key
+type ConsulWatchStatusSorter []ConsulWatchStatus
+
+func (a ConsulWatchStatusSorter) Len() int           { return len(a) }
+func (a ConsulWatchStatusSorter) Less(i, j int) bool { return a[i].WatchKey < a[j].WatchKey }
+func (a ConsulWatchStatusSorter) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// isPermissionDenied reports whether err is a Consul ACL error
+func isPermissionDenied(err error) bool {
+	return strings.Contains(err.Error(), "Permission denied") || strings.Contains(err.Error(), "ACL not found")
+}
+
+// payloadChanged reports whether payload differs from the one last sent by a
+// watch, by comparing a fnv hash of its JSON encoding with last. Consul bumps
+// the index on unrelated changes, so an advanced index alone isn't enough.
+func (c *ConsulConnection) payloadChanged(payload interface{}, last *uint64) bool {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return true
+	}
+
+	h := fnv.New64a()
+	h.Write(b)
+	checksum := h.Sum64()
+
+	if checksum == *last {
+		return false
+	}
+
+	*last = checksum
+	return true
 }
 
+// writePump writes the queued actions and pings to the socket. Every write has to complete
+// within writeWait, a failed write closes the socket so readPump tears the connection down.
 func (c *ConsulConnection) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	var seq uint64
+
 	defer func() {
+		ticker.Stop()
 		c.socket.Close()
 	}()
 
 	for {
 		select {
-		case <-c.destroyCh:
+		case <-c.ctx.Done():
 			c.Warningf("Stopping writePump")
+			c.socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.socket.WriteMessage(websocket.CloseMessage, []byte{}); err != nil {
+				c.Errorf("Could not write close message to websocket: %s", err)
+			}
 			return
 
-		case action, ok := <-c.send:
-			if !ok {
-				if err := c.socket.WriteMessage(websocket.CloseMessage, []byte{}); err != nil {
-					c.Errorf("Could not write close message to websocket: %s", err)
-				}
+		case <-ticker.C:
+			c.socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.socket.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				c.Errorf("Could not write ping message to websocket: %s", err)
 				return
 			}
 
-			if err := c.socket.WriteJSON(action); err != nil {
+		case action := <-c.send:
+			c.lock.RLock()
+			batch, window, compress, gzipPayloads := c.batchFrames, c.batchWindow, c.writeCompression, c.gzipPayloads
+			c.lock.RUnlock()
+
+			var frame interface{} = action
+			if batch {
+				// give the watchers a moment to queue more actions, for clients preferring fewer frames
+				if window > 0 {
+					time.Sleep(window)
+				}
+				frame = batchActions(action, c.send)
+			}
+			frame = sequenceFrame(frame, &seq)
+
+			// the occasional huge services or nodes list is gzipped, for clients not negotiating permessage-deflate
+			if gzipPayloads {
+				switch f := frame.(type) {
+				case *Action:
+					frame = gzipAction(f, c.region.Config.WebsocketGzipThreshold)
+				case []*Action:
+					for i := range f {
+						f[i] = gzipAction(f[i], c.region.Config.WebsocketGzipThreshold)
+					}
+				}
+			}
+
+			c.socket.EnableWriteCompression(compress)
+			c.socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.socket.WriteJSON(frame); err != nil {
 				c.Errorf("Could not write action to websocket: %s", err)
+				return
 			}
 		}
 	}
@@ -106,13 +765,42 @@ func (c *ConsulConnection) readPump() {
 	// Register this connection with the hub for broadcast updates
 	c.hub.register <- c
 
-	var action Action
+	// Oversized messages fail the read, which tears down the connection
+	c.socket.SetReadLimit(c.region.Config.WebsocketReadLimit)
+
+	// Tear down the connection if the client stops answering our pings
+	c.socket.SetReadDeadline(time.Now().Add(pongWait))
+	c.socket.SetPongHandler(func(string) error {
+		c.socket.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
 	for {
-		err := c.socket.ReadJSON(&action)
+		// only failing to read a message ends the connection, a message that isn't a valid
+		// action is reported to the client and skipped
+		_, message, err := c.socket.ReadMessage()
 		if err != nil {
 			break
 		}
 
+		var raw consulRawAction
+		if err := json.Unmarshal(message, &raw); err != nil {
+			c.Warningf("Ignoring a malformed message: %s", err)
+			c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Ignoring a malformed message: %s", err)})
+			continue
+		}
+
+		c.lock.Lock()
+		c.lastActivity = time.Now()
+		c.lock.Unlock()
+
+		action, err := decodeConsulAction(raw)
+		if err != nil {
+			c.Warningf("Ignoring %s with a malformed payload: %s", raw.Type, err)
+			c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Ignoring %s with a malformed payload: %s", raw.Type, err), RequestID: raw.RequestID})
+			continue
+		}
+
 		c.process(action)
 	}
 }
@@ -120,6 +808,16 @@ func (c *ConsulConnection) readPump() {
 func (c *ConsulConnection) process(action Action) {
 	c.Debugf("Processing event %s (index %d)", action.Type, action.Index)
 
+	c.lock.RLock()
+	identity := ConnectionIdentity{Backend: "consul", ConnectionID: c.shortID, RemoteAddr: c.socket.RemoteAddr().String(), Token: c.token}
+	c.lock.RUnlock()
+
+	if err := authorizeAction(identity, action.Type); err != nil {
+		c.Warningf("Denied %s: %s", action.Type, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: deniedActionMessage(action.Type, err)})
+		return
+	}
+
 	switch action.Type {
 
 	//
@@ -127,32 +825,104 @@ func (c *ConsulConnection) process(action Action) {
 	//
 	case fetchConsulRegions:
 		go c.fetchRegions()
+	case fetchConsulDatacenters:
+		go c.fetchDatacenters()
+	case fetchConsulAgentSelf:
+		go c.fetchAgentSelf()
+	case fetchConsulRegionStatus:
+		go c.fetchRegionStatus(action)
+	case searchConsul:
+		go c.searchConsul(action)
+
+	//
+	// Per-connection settings
+	//
+	case clientHello:
+		c.clientHello(action)
+	case setConsulToken:
+		c.setToken(action)
+	case setConsulDatacenter:
+		go c.setDatacenter(action)
+	case setConsulNamespace:
+		go c.setNamespace(action)
+	case setConsulAllowStale:
+		c.setAllowStale(action)
+	case refreshConsulWatch:
+		go c.refreshWatch(action)
+	case keepAlive:
+		// nothing to do, any message marks the connection as active
+	case unwatchAll:
+		c.unwatchAll()
+	case fetchWatchStatus:
+		go c.fetchWatchStatus()
+	case fetchActiveWatches:
+		go c.fetchActiveWatches()
 
 	//
 	// Consul services
 	//
 	case watchConsulServices:
-		go c.watchGenericBroadcast("services", fetchedConsulServices, c.region.broadcastChannels.services, c.region.services)
+		c.startWatch(func() { c.watchConsulServices(action) })
 	case unwatchConsulServices:
 		c.unwatchGenericBroadcast("services")
+	case watchConsulServicesMultiRegion:
+		c.watchConsulServicesMultiRegion(action)
+	case unwatchConsulServicesMultiRegion:
+		c.unwatchConsulServicesMultiRegion(action)
+	case watchConsulServiceGroup:
+		c.startWatch(func() { c.watchConsulServiceGroup(action) })
+	case unwatchConsulServiceGroup:
+		if names, ok := action.Payload.([]string); ok {
+			c.watches.Remove(consulServiceGroupKey(names))
+		}
+	case watchConsulServiceAllDC:
+		c.startWatch(func() { c.watchConsulServiceAllDC(action) })
+	case unwatchConsulServiceAllDC:
+		if service, ok := c.stringPayload(action); ok {
+			c.watches.Remove(consulServiceAllDCKey(service))
+		}
+	case watchConsulConnectServices:
+		c.startWatch(func() { c.watchConsulConnectServices(action) })
+	case unwatchConsulConnectServices:
+		c.watches.Remove("consul/connect/services")
 
 	//
 	// Consul service (single)
 	//
 	case watchConsulService:
-		go c.watchConsulService(action)
+		c.startWatch(func() { c.watchConsulService(action) })
 	case unwatchConsulService:
-		c.watches.Remove(action.Payload.(string))
+		_, _, _, key := consulServiceWatch(action.Payload)
+		c.watches.Remove(key)
+	case registerConsulService:
+		go c.registerConsulService(action)
 	case dereigsterConsulService:
 		go c.dereigsterConsulService(action)
 	case dereigsterConsulServiceCheck:
 		go c.dereigsterConsulServiceCheck(action)
 
+	//
+	// Consul catalog service (instances with node addresses)
+	//
+	case watchConsulCatalogService:
+		c.startWatch(func() { c.watchConsulCatalogService(action) })
+	case unwatchConsulCatalogService:
+		_, _, key := consulCatalogServiceWatch(action.Payload)
+		c.watches.Remove(key)
+
+	//
+	// Consul maintenance mode
+	//
+	case toggleConsulNodeMaintenance:
+		go c.toggleConsulNodeMaintenance(action)
+	case toggleConsulServiceMaintenance:
+		go c.toggleConsulServiceMaintenance(action)
+
 	//
 	// Consul nodes
 	//
 	case watchConsulNodes:
-		go c.watchGenericBroadcast("nodes", fetchedConsulNodes, c.region.broadcastChannels.nodes, c.region.nodes)
+		c.startWatch(func() { c.watchConsulNodes(action) })
 	case unwatchConsulNodes:
 		c.unwatchGenericBroadcast("nodes")
 
@@ -160,485 +930,3105 @@ func (c *ConsulConnection) process(action Action) {
 	// Consul node (single)
 	//
 	case watchConsulNode:
-		go c.watchConsulNode(action)
+		c.startWatch(func() { c.watchConsulNode(action) })
 	case unwatchConsulNode:
-		c.watches.Remove("consul/node/" + action.Payload.(string))
+		if payload, ok := c.stringPayload(action); ok {
+			c.watches.Remove("consul/node/" + payload)
+		}
+	case watchConsulNodeServices:
+		c.startWatch(func() { c.watchConsulNodeServices(action) })
+	case unwatchConsulNodeServices:
+		if payload, ok := c.stringPayload(action); ok {
+			c.watches.Remove(consulNodeServicesKey(payload))
+		}
+
+	//
+	// Consul health checks in a given state
+	//
+	case watchConsulChecksInState:
+		c.startWatch(func() { c.watchConsulChecksInState(action) })
+	case unwatchConsulChecksInState:
+		if payload, ok := c.stringPayload(action); ok {
+			c.watches.Remove("consul/checks/state?" + payload)
+		}
+
+	//
+	// Consul health checks of a single service
+	//
+	case watchConsulServiceChecks:
+		c.startWatch(func() { c.watchConsulServiceChecks(action) })
+	case unwatchConsulServiceChecks:
+		if payload, ok := c.stringPayload(action); ok {
+			c.watches.Remove("consul/service/checks?" + payload)
+		}
+
+	//
+	// Consul Connect intentions
+	//
+	case watchConsulIntentions:
+		c.startWatch(func() { c.watchConsulIntentions(action) })
+	case unwatchConsulIntentions:
+		c.watches.Remove("consul/intentions")
+	case createConsulIntention:
+		go c.createConsulIntention(action)
+	case deleteConsulIntention:
+		go c.deleteConsulIntention(action)
 
 	//
 	// Watch a KV path
 	//
 	case watchConsulKVPath:
-		go c.watchConsulKVPath(action)
+		c.startWatch(func() { c.watchConsulKVPath(action) })
 	case unwatchConsulKVPath:
-		c.watches.Remove("consul/kv/path?" + action.Payload.(string))
+		if payload, ok := c.stringPayload(action); ok {
+			c.watches.Remove("consul/kv/path?" + payload)
+		}
 	case setConsulKVPair:
 		go c.writeConsulKV(action)
 	case deleteConsulKvFolder:
-		go c.deleteConsulKV(action)
+		go c.deleteConsulKvFolder(action)
 	case getConsulKVPair:
 		go c.getConsulKVPair(action)
 	case deleteConsulKvPair:
 		go c.deleteConsulKvPair(action)
 
 	//
-	// Nice in debug
+	// Watch all KV pairs below a prefix
 	//
-	default:
-		logger.Warningf("Unknown action: %s", action.Type)
-	}
-}
+	case watchConsulKVPrefix:
+		c.startWatch(func() { c.watchConsulKVPrefix(action) })
+	case unwatchConsulKVPrefix:
+		if payload, ok := c.stringPayload(action); ok {
+			c.watches.Remove("consul/kv/prefix?" + payload)
+		}
 
-// Handle monitors the websocket connection for incoming actions. It sends
+	//
+	// Watch the KV keys held by a session below a prefix
+	//
+	case watchConsulLocks:
+		c.startWatch(func() { c.watchConsulLocks(action) })
+	case unwatchConsulLocks:
+		if payload, ok := c.stringPayload(action); ok {
+			c.watches.Remove("consul/locks?" + payload)
+		}
+
+	//
+	// Watch a single KV key
+	//
+	case watchConsulKV:
+		c.startWatch(func() { c.watchConsulKV(action) })
+	case unwatchConsulKV:
+		if payload, ok := c.stringPayload(action); ok {
+			c.watches.Remove("consul/kv?" + payload)
+		}
+	case setConsulKV:
+		go c.setConsulKV(action)
+	case deleteConsulKV:
+		go c.deleteConsulKV(action)
+	case deleteConsulKVTree:
+		go c.deleteConsulKVTree(action)
+	case consulTxn:
+		go c.consulTxn(action)
+
+	//
+	// Consul prepared queries
+	//
+	case watchConsulPreparedQueries:
+		c.startWatch(func() { c.watchConsulPreparedQueries(action) })
+	case unwatchConsulPreparedQueries:
+		c.watches.Remove("consul/prepared-queries")
+	case executeConsulPreparedQuery:
+		go c.executeConsulPreparedQuery(action)
+
+	//
+	// Consul sessions
+	//
+	case watchConsulSessions:
+		c.startWatch(func() { c.watchConsulSessions(action) })
+	case unwatchConsulSessions:
+		c.watches.Remove("consul/sessions")
+	case destroyConsulSession:
+		go c.destroyConsulSession(action)
+
+	//
+	// Consul agent members (LAN, or WAN if the payload is true)
+	//
+	case watchConsulMembers:
+		c.startWatch(func() { c.watchConsulMembers(action) })
+	case unwatchConsulMembers:
+		wan, _ := action.Payload.(bool)
+		c.watches.Remove(consulMembersKey(wan))
+
+	//
+	// Consul network coordinates
+	//
+	case fetchConsulNodeRTT:
+		go c.fetchConsulNodeRTT(action)
+	case watchConsulCoordinates:
+		c.startWatch(func() { c.watchConsulCoordinates() })
+	case unwatchConsulCoordinates:
+		c.watches.Remove("consul/coordinates")
+
+	//
+	// Consul user events
+	//
+	case watchConsulEvents:
+		c.startWatch(func() { c.watchConsulEvents() })
+	case unwatchConsulEvents:
+		c.watches.Remove("consul/events")
+	case fireConsulEvent:
+		go c.fireConsulEvent(action)
+
+	//
+	// Consul ACL tokens
+	//
+	case watchConsulACLTokens:
+		c.startWatch(func() { c.watchConsulACLTokens(action) })
+	case unwatchConsulACLTokens:
+		c.watches.Remove("consul/acl/tokens")
+	case watchConsulACLPolicies:
+		c.sendAction(&Action{Type: errorNotification, Payload: "Unable to watch Consul ACL policies - only legacy ACL tokens are supported"})
+	case createConsulACLToken:
+		go c.createConsulACLToken(action)
+	case deleteConsulACLToken:
+		go c.deleteConsulACLToken(action)
+	case readConsulACLToken:
+		go c.readConsulACLToken(action)
+
+	//
+	// Consul raft peers
+	//
+	case watchConsulRaftConfiguration:
+		c.startWatch(func() { c.watchConsulRaftConfiguration() })
+	case unwatchConsulRaftConfiguration:
+		c.watches.Remove("consul/raft/configuration")
+
+	//
+	// Consul health summary (counts for dashboards)
+	//
+	case watchConsulHealthSummary:
+		c.startWatch(func() { c.watchConsulHealthSummary() })
+	case unwatchConsulHealthSummary:
+		c.watches.Remove("consul/health/summary")
+
+	//
+	// Nice in debug
+	//
+	default:
+		logger.Warningf("Unknown action: %s", action.Type)
+	}
+}
+
+// Handle monitors the websocket connection for incoming actions. It sends
 // out actions on state changes.
 func (c *ConsulConnection) Handle() {
-	go c.keepAlive()
 	go c.writePump()
+	go c.sendConnectionStats()
+	if timeout := c.region.Config.ConsulIdleTimeout; timeout > 0 {
+		go c.closeWhenIdle(timeout)
+	}
 	c.readPump()
 
 	c.Debugf("Connection closing down")
 
-	c.destroyCh <- struct{}{}
+	// Stop the writePump and any remaining watcher routines
+	c.cancel()
+}
+
+// sendConnectionStats sends the server time, the active watches and the hashi-ui version every
+// connectionStatsInterval, until the connection is closed
+func (c *ConsulConnection) sendConnectionStats() {
+	ticker := time.NewTicker(connectionStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
 
-	// Kill any remaining watcher routines
-	close(c.destroyCh)
+		case <-ticker.C:
+			c.sendAction(&Action{Type: connectionStats, Payload: &ConnectionStats{ServerTime: time.Now().UTC(), Watches: c.activeWatches(), Version: version}})
+		}
+	}
 }
 
-func (c *ConsulConnection) keepAlive() {
-	logger.Debugf("Starting keep-alive packer sender")
-	ticker := time.NewTicker(10 * time.Second)
+// closeWhenIdle closes the connection once the client sent nothing for timeout (pongs aren't
+// taken into account, browsers answer them for a forgotten tab too). The client is warned with
+// CONNECTION_IDLE first, and any message sent within idleGracePeriod keeps the connection open.
+func (c *ConsulConnection) closeWhenIdle(timeout time.Duration) {
+	ticker := time.NewTicker(idleCheckInterval(timeout))
+	defer ticker.Stop()
 
+	warned := false
 	for {
 		select {
-		case <-c.destroyCh:
+		case <-c.ctx.Done():
 			return
+
 		case <-ticker.C:
-			logger.Debugf("Sending keep-alive packet")
-			c.socket.WriteMessage(websocket.PingMessage, []byte("keepalive"))
+			c.lock.RLock()
+			idle := time.Since(c.lastActivity)
+			c.lock.RUnlock()
+
+			switch {
+			case idle < timeout:
+				warned = false
+
+			case !warned:
+				c.Infof("Connection is idle for %s, closing it in %s unless the client answers", idle, idleGracePeriod)
+				c.sendAction(&Action{Type: connectionIdle, Payload: struct {
+					IdleFor   int64
+					ClosingIn int64
+				}{
+					IdleFor:   int64(idle / time.Second),
+					ClosingIn: int64(idleGracePeriod / time.Second),
+				}})
+				warned = true
+
+			case idle >= timeout+idleGracePeriod:
+				c.Warningf("Closing connection idle for %s", idle)
+				c.socket.Close()
+				return
+			}
 		}
 	}
 }
 
-func (c *ConsulConnection) fetchRegions() {
-	c.send <- &Action{Type: fetchedConsulRegions, Payload: c.hub.regions}
+// idleCheckInterval is how often closeWhenIdle looks at the connection activity, a fraction of
+// the timeout and the grace period so neither is overshot by much
+func idleCheckInterval(timeout time.Duration) time.Duration {
+	interval := idleGracePeriod / 4
+	if quarter := timeout / 4; quarter < interval {
+		interval = quarter
+	}
+
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	return interval
 }
 
-func (c *ConsulConnection) watchGenericBroadcast(watchKey string, actionEvent string, prop observer.Property, initialPayload interface{}) {
-	if c.watches.Has(watchKey) {
-		c.Warningf("Connection is already subscribed to %s", actionEvent)
+// activeWatches returns the sorted keys of the watches the connection holds. The set is shared
+// with the watch routines, but its methods are safe for concurrent use.
+func (c *ConsulConnection) activeWatches() []string {
+	watches := set.StringSlice(c.watches)
+	sort.Strings(watches)
+
+	return watches
+}
+
+// fetchActiveWatches sends the keys of the watches the connection holds, to spot subscription leaks
+func (c *ConsulConnection) fetchActiveWatches() {
+	c.sendAction(&Action{Type: fetchedActiveWatches, Payload: c.activeWatches()})
+}
+
+// startWatch runs a watch routine, unless the connection already runs ConsulMaxWatches of them, in
+// which case the watch is refused so a client can't spawn an unbounded number of goroutines.
+func (c *ConsulConnection) startWatch(watch func()) {
+	running := atomic.AddInt32(&c.runningWatches, 1)
+
+	if limit := c.region.Config.ConsulMaxWatches; limit > 0 && running > int32(limit) {
+		atomic.AddInt32(&c.runningWatches, -1)
+		c.Warningf("Refusing watch, the connection already runs %d watches", limit)
+		c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to start watch - the limit of %d watches per connection is reached", limit)})
 		return
 	}
 
-	defer func() {
-		c.watches.Remove(watchKey)
-		c.Infof("Stopped watching %s", watchKey)
-
-		// recovering from panic caused by writing to a closed channel
-		if r := recover(); r != nil {
-			c.Warningf("Recover from panic: %s", r)
-		}
+	c.hub.routines.Add(1)
+	go func() {
+		defer c.hub.routines.Done()
+		defer atomic.AddInt32(&c.runningWatches, -1)
+		watch()
 	}()
+}
 
-	c.watches.Add(watchKey)
+// stringPayload returns the payload of an action that must be a string. Malformed payloads are
+// logged and reported as not ok, so a bad client can't crash the connection.
+func (c *ConsulConnection) stringPayload(action Action) (string, bool) {
+	payload, ok := action.Payload.(string)
+	if !ok {
+		c.Warningf("Ignoring %s with a non-string payload: %v", action.Type, action.Payload)
+	}
 
-	c.Debugf("Sending our current %s list", watchKey)
-	c.send <- &Action{Type: actionEvent, Payload: initialPayload, Index: 0}
+	return payload, ok
+}
 
-	stream := prop.Observe()
+// setToken changes the ACL token used by the connection specific watches and writes. The shared
+// services and nodes broadcasts are always fetched with the region default token.
+func (c *ConsulConnection) setToken(action Action) {
+	token, ok := action.Payload.(string)
+	if !ok && action.Payload != nil {
+		c.Errorf("Could not decode payload")
+		return
+	}
 
-	c.Debugf("Started watching %s", watchKey)
-	for {
-		select {
-		case <-c.destroyCh:
+	// wake up the watches paused on a permission error, they retry with the new token
+	c.lock.Lock()
+	c.token = token
+	close(c.tokenChanged)
+	c.tokenChanged = make(chan struct{})
+	c.lock.Unlock()
+
+	if token == "" {
+		c.Infof("Using the default Consul ACL token")
+		return
+	}
+
+	c.Infof("Using a connection specific Consul ACL token")
+}
+
+// aclToken returns the ACL token set for the connection, or the region default when none is set
+func (c *ConsulConnection) aclToken() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.token != "" {
+		return c.token
+	}
+
+	return c.region.Config.ConsulACLToken
+}
+
+// queryOptions builds the QueryOptions for a (blocking) query made on behalf of the connection
+func (c *ConsulConnection) queryOptions(waitIndex uint64, waitTime time.Duration) *api.QueryOptions {
+	c.lock.RLock()
+	allowStale, datacenter := c.allowStale, c.datacenter
+	c.lock.RUnlock()
+
+	return &api.QueryOptions{WaitIndex: waitIndex, WaitTime: waitTime, Token: c.aclToken(), AllowStale: allowStale, Datacenter: datacenter}
+}
+
+// setDatacenter points the connection at another datacenter of a WAN federation, reached through
+// the local Consul servers. Running watches still query the previous datacenter, so they are all
+// stopped (see UNWATCH_ALL) for the client to subscribe again. An empty payload goes back to the
+// region datacenter. A datacenter that doesn't answer is refused, keeping the current one.
+func (c *ConsulConnection) setDatacenter(action Action) {
+	datacenter, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+
+	if datacenter == c.region.Datacenter {
+		datacenter = ""
+	}
+
+	c.lock.RLock()
+	current := c.datacenter
+	c.lock.RUnlock()
+
+	if datacenter == current {
+		return
+	}
+
+	if datacenter != "" {
+		_, _, err := c.requestClient().Catalog().Services(&api.QueryOptions{Token: c.aclToken(), Datacenter: datacenter})
+		if err != nil {
+			c.Warningf("Unable to reach datacenter %s: %s", datacenter, err)
+			c.sendAction(&Action{Type: errorNotification, Payload: &ErrorNotification{
+				Message:  fmt.Sprintf("Unable to switch to datacenter %s, it can't be reached through the WAN federation: %s", datacenter, err),
+				Severity: severityError,
+			}})
 			return
+		}
+	}
 
-		case <-stream.Changes():
-			// advance to next value
-			stream.Next()
+	c.lock.Lock()
+	c.datacenter = datacenter
+	c.remoteServices = nil
+	c.remoteNodes = nil
+	c.lock.Unlock()
 
-			channelAction := stream.Value().(*Action)
-			c.Debugf("got new data for %s (WaitIndex: %d)", watchKey, channelAction.Index)
+	c.unwatchAll()
 
-			if !c.watches.Has(watchKey) {
-				c.Infof("Connection is no longer subscribed to %s", watchKey)
-				return
-			}
+	if datacenter == "" {
+		datacenter = c.region.Datacenter
+	}
 
-			if channelAction.Type != actionEvent {
-				c.Debugf("Type mismatch: %s <> %s", channelAction.Type, actionEvent)
-				continue
-			}
+	c.Infof("Using the datacenter %s", datacenter)
+	c.sendAction(&Action{Type: successNotification, Payload: fmt.Sprintf("Now browsing the datacenter %s.", datacenter)})
+}
+
+// setNamespace scopes the connection to a namespace of Consul Enterprise (1.7 or later). The
+// vendored API client has no option for namespaces, so the queries and writes of the connection
+// go through clients adding the ns parameter to every request. Like SET_CONSUL_DATACENTER, the
+// running watches are stopped for the client to subscribe again. An empty payload goes back to
+// the default namespace of the agent. A namespace that can't be read is refused.
+func (c *ConsulConnection) setNamespace(action Action) {
+	namespace, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+
+	c.lock.RLock()
+	current := c.namespace
+	c.lock.RUnlock()
+
+	if namespace == current {
+		return
+	}
+
+	client, requestClient, err := c.newClients(namespace)
+	if err != nil {
+		c.Errorf("Unable to create the Consul clients of namespace %s: %s", namespace, err)
+		c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to switch to namespace %s: %s", namespace, err)})
+		return
+	}
 
-			c.Debugf("Publishing change %s %s", channelAction.Type, watchKey)
-			c.send <- channelAction
+	if namespace != "" {
+		// agents without namespaces ignore the ns parameter, but don't know the endpoint
+		var result map[string]interface{}
+		if _, err := requestClient.Raw().Query("/v1/namespace/"+url.QueryEscape(namespace), &result, c.queryOptions(0, 0)); err != nil {
+			c.Warningf("Unable to use namespace %s: %s", namespace, err)
+			c.sendAction(&Action{Type: errorNotification, Payload: &ErrorNotification{
+				Message:  fmt.Sprintf("Unable to switch to namespace %s, namespaces need Consul Enterprise 1.7 or later: %s", namespace, err),
+				Severity: severityError,
+			}})
+			return
 		}
 	}
+
+	c.lock.Lock()
+	c.namespace = namespace
+	c.consulClient = client
+	c.consulRequestClient = requestClient
+	c.remoteServices = nil
+	c.remoteNodes = nil
+	c.lock.Unlock()
+
+	c.unwatchAll()
+
+	if namespace == "" {
+		c.Infof("Using the default namespace")
+		c.sendAction(&Action{Type: successNotification, Payload: "Now browsing the default namespace."})
+		return
+	}
+
+	c.Infof("Using the namespace %s", namespace)
+	c.sendAction(&Action{Type: successNotification, Payload: fmt.Sprintf("Now browsing the namespace %s.", namespace)})
 }
 
-func (c *ConsulConnection) unwatchGenericBroadcast(watchKey string) {
-	c.Debugf("Removing subscription for %s", watchKey)
-	c.watches.Remove(watchKey)
+// remoteNamespace returns the namespace the connection is scoped to, if any
+func (c *ConsulConnection) remoteNamespace() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.namespace
 }
 
-func (c *ConsulConnection) watchConsulService(action Action) {
-	serviceID := action.Payload.(string)
+// remoteDatacenter returns the remote datacenter the connection is pointed at, if any
+func (c *ConsulConnection) remoteDatacenter() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.datacenter
+}
+
+// scoped reports whether the connection is pointed at a remote datacenter or a namespace, which
+// the region broadcasts of services and nodes don't cover
+func (c *ConsulConnection) scoped() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.datacenter != "" || c.namespace != ""
+}
+
+// newClients creates the Consul clients of the connection scoped to namespace, empty for the
+// default namespace of the agent
+func (c *ConsulConnection) newClients(namespace string) (*api.Client, *api.Client, error) {
+	client, err := CreateConsulConnectionClient(c.region.Config, c.region.Datacenter, namespace, 0, c.requestContext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	requestClient, err := CreateConsulConnectionClient(c.region.Config, c.region.Datacenter, namespace, c.region.Config.ConsulRequestTimeout, c.requestContext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, requestClient, nil
+}
+
+// requestContext returns the context a Consul request of the connection runs under: blocking
+// queries (the ones with an index) are aborted when the watches stop, on UNWATCH_ALL or when
+// the connection closes, the other requests only when the connection closes
+func (c *ConsulConnection) requestContext(req *http.Request) context.Context {
+	if req.URL.Query().Get("index") != "" {
+		return c.watchContext()
+	}
+
+	return c.ctx
+}
+
+// client returns the Consul client for the blocking queries and the writes of the connection,
+// scoped to its namespace
+func (c *ConsulConnection) client() *api.Client {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
-	if c.watches.Has(serviceID) {
-		c.Warningf("Connection is already subscribed to service %s", serviceID)
+	if c.consulClient != nil {
+		return c.consulClient
+	}
+
+	return c.region.Client
+}
+
+// requestClient returns the Consul client for the one-shot requests of the connection, scoped
+// to its namespace
+func (c *ConsulConnection) requestClient() *api.Client {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.consulRequestClient != nil {
+		return c.consulRequestClient
+	}
+
+	return c.region.RequestClient
+}
+
+// cachedServices returns the latest services list of the connection datacenter
+func (c *ConsulConnection) cachedServices() *ConsulInternalServices {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.datacenter != "" || c.namespace != "" {
+		return c.remoteServices
+	}
+
+	return c.region.services
+}
+
+// cachedNodes returns the latest nodes list of the connection datacenter
+func (c *ConsulConnection) cachedNodes() *ConsulInternalNodes {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.datacenter != "" || c.namespace != "" {
+		return c.remoteNodes
+	}
+
+	return c.region.nodes
+}
+
+// setAllowStale lets the watches of the connection read from any Consul server instead of just
+// the leader, trading consistency for less load on the leader. Reads are consistent by default.
+func (c *ConsulConnection) setAllowStale(action Action) {
+	allowStale, ok := action.Payload.(bool)
+	if !ok {
+		c.Errorf("Could not decode payload")
 		return
 	}
 
-	defer func() {
-		c.watches.Remove(serviceID)
-		c.Infof("Stopped watching service with id: %s", serviceID)
-	}()
-	c.watches.Add(serviceID)
+	c.lock.Lock()
+	c.allowStale = allowStale
+	c.lock.Unlock()
+
+	c.Infof("Stale reads are now %s", onOff(allowStale))
+}
+
+// actionMeta returns how fresh and trustworthy the result of a query is, for connections making
+// stale reads or asking for the query meta in CLIENT_HELLO. Other connections get nil.
+func (c *ConsulConnection) actionMeta(meta *api.QueryMeta) *ActionMeta {
+	if !c.sendsQueryMeta() {
+		return nil
+	}
+
+	return newActionMeta(meta)
+}
+
+// sendsQueryMeta reports whether the actions sent to the connection carry their query meta
+func (c *ConsulConnection) sendsQueryMeta() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.allowStale || c.queryMeta
+}
 
-	c.Infof("Started watching service with id: %s", serviceID)
+// withQueryMeta returns action without its query meta when the connection doesn't want it. The
+// broadcast actions are shared by all the connections, so they are copied rather than modified.
+func (c *ConsulConnection) withQueryMeta(action *Action) *Action {
+	if action.Meta == nil || c.sendsQueryMeta() {
+		return action
+	}
+
+	stripped := *action
+	stripped.Meta = nil
+	return &stripped
+}
+
+// newActionMeta converts the query meta of a Consul response
+func newActionMeta(meta *api.QueryMeta) *ActionMeta {
+	if meta == nil {
+		return nil
+	}
+
+	return &ActionMeta{
+		LastContact: int64(meta.LastContact / time.Millisecond),
+		KnownLeader: meta.KnownLeader,
+		RequestTime: int64(meta.RequestTime / time.Millisecond),
+	}
+}
+
+// writeOptions builds the WriteOptions for a write made on behalf of the connection
+func (c *ConsulConnection) writeOptions() *api.WriteOptions {
+	return &api.WriteOptions{Token: c.aclToken(), Datacenter: c.remoteDatacenter()}
+}
+
+func (c *ConsulConnection) fetchRegions() {
+	c.sendAction(&Action{Type: fetchedConsulRegions, Payload: c.hub.regions})
+}
+
+func (c *ConsulConnection) fetchDatacenters() {
+	datacenters, err := c.requestClient().Catalog().Datacenters()
+	if err == nil {
+		c.sendAction(&Action{Type: fetchedConsulDatacenters, Payload: &ConsulDatacenters{Datacenters: datacenters}})
+		return
+	}
+
+	c.Errorf("connection: unable to fetch consul datacenters: %s", err)
+
+	// fall back to the datacenter of the agent we are talking to
+	result := &ConsulDatacenters{Datacenters: make([]string, 0), Error: err.Error()}
+
+	self, selfErr := c.requestClient().Agent().Self()
+	if selfErr != nil {
+		c.Errorf("connection: unable to fetch consul agent info: %s", selfErr)
+		result.Error = fmt.Sprintf("%s (local datacenter unknown: %s)", err, selfErr)
+	} else if dc, ok := self["Config"]["Datacenter"].(string); ok {
+		result.Datacenters = append(result.Datacenters, dc)
+	}
+
+	c.sendAction(&Action{Type: fetchedConsulDatacenters, Payload: result})
+}
+
+// searchConsul looks for the services, nodes and KV keys containing the query given as payload,
+// ignoring case. Services and nodes are searched in the region state the UI lists, while the KV
+// keys are listed with the connection ACL token so the results only show what it may read.
+func (c *ConsulConnection) searchConsul(action Action) {
+	query, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+
+	results := &ConsulSearchResults{Query: query, Services: make([]string, 0), Nodes: make([]string, 0), Keys: make([]string, 0)}
+
+	needle := strings.ToLower(strings.TrimSpace(query))
+	if needle == "" {
+		c.sendAction(&Action{Type: fetchedConsulSearchResults, Payload: results})
+		return
+	}
+
+	match := func(matches []string, candidate string) []string {
+		if !strings.Contains(strings.ToLower(candidate), needle) {
+			return matches
+		}
+		if len(matches) == consulSearchLimit {
+			results.Truncated = true
+			return matches
+		}
+		return append(matches, candidate)
+	}
+
+	if services := c.cachedServices(); services != nil {
+		for _, service := range *services {
+			results.Services = match(results.Services, service.Name)
+		}
+	}
+
+	if nodes := c.cachedNodes(); nodes != nil {
+		for _, node := range *nodes {
+			results.Nodes = match(results.Nodes, node.Node)
+		}
+	}
+
+	keys, _, err := c.requestClient().KV().Keys("", "", c.queryOptions(0, 0))
+	if err != nil {
+		c.Errorf("connection: unable to search KV keys: %s", err)
+		c.sendAction(&Action{Type: errorNotification, Payload: &ErrorNotification{
+			Message:  fmt.Sprintf("Unable to search the KV store: %s", err),
+			Severity: severityWarning,
+		}})
+	} else {
+		for _, key := range keys {
+			results.Keys = match(results.Keys, key)
+		}
+	}
+
+	sort.Strings(results.Services)
+	sort.Strings(results.Nodes)
+
+	c.sendAction(&Action{Type: fetchedConsulSearchResults, Payload: results})
+}
+
+// fetchRegionStatus asks the region given as payload (or the connection region) for its leader,
+// so the UI can tell an unreachable region apart from an empty one
+func (c *ConsulConnection) fetchRegionStatus(action Action) {
+	name, _ := action.Payload.(string)
+	if name == "" {
+		name = c.region.Datacenter
+	}
+
+	region, ok := c.hub.region(name)
+	if !ok {
+		c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to fetch the status of %s - unknown region", name)})
+		return
+	}
+
+	// the status client aborts the request after consulRegionStatusTimeout
+	started := time.Now()
+	leader, err := region.statusClient.Status().Leader()
+
+	status := &ConsulRegionStatus{Region: name, Latency: int64(time.Since(started) / time.Millisecond)}
+
+	switch {
+	case err != nil:
+		status.Error = err.Error()
+	case leader == "":
+		status.Error = "no cluster leader"
+	default:
+		status.Reachable = true
+		status.Leader = leader
+	}
+
+	if !status.Reachable {
+		c.Warningf("Region %s is unreachable: %s", name, status.Error)
+	}
+
+	c.sendAction(&Action{Type: fetchedConsulRegionStatus, Payload: status})
+}
+
+// fetchAgentSelf sends the version, datacenter and configuration of the Consul agent, so the UI
+// can hide features (like intentions) the agent doesn't have enabled
+func (c *ConsulConnection) fetchAgentSelf() {
+	self, err := c.region.fetchAgentSelf()
+	if err != nil {
+		c.Errorf("connection: unable to fetch consul agent info: %s", err)
+		c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to fetch the Consul agent info: %s", err)})
+		return
+	}
+
+	c.sendAction(&Action{Type: fetchedConsulAgentSelf, Payload: self})
+}
+
+// watchGenericBroadcast streams a region broadcast to the connection. When filter is set, every
+// action is passed through it before being sent. A client resuming from sinceIndex doesn't get
+// the initial payload, unless the broadcast moved past that index in the meantime.
+func (c *ConsulConnection) watchGenericBroadcast(watchKey string, actionEvent string, prop observer.Property, history *actionRing, initialPayload interface{}, sinceIndex uint64, filter func(*Action) *Action) {
+	log := c.log.With("watch", watchKey)
+
+	if c.watches.Has(watchKey) {
+		log.Warningf("Connection is already subscribed to %s", actionEvent)
+		c.sendWatchEvent(consulWatchStarted, watchKey, true)
+		return
+	}
+
+	ctx := c.watchContext()
+	defer c.stopWatch(ctx, watchKey)
+
+	c.addWatch(ctx, watchKey)
+	c.sendWatchEvent(consulWatchStarted, watchKey, false)
+
+	stream := prop.Observe()
+
+	current, _ := prop.Value().(*Action)
+	if sinceIndex > 0 && current != nil && current.Index <= sinceIndex {
+		log.Debugf("Client is up to date with %s at index %d, skipping the initial list", watchKey, sinceIndex)
+	} else if recent := history.Since(sinceIndex); len(recent) > 0 {
+		// the most recent update is the current list, so the older ones are replayed before it
+		log.Debugf("Replaying the last %d %s updates", len(recent), watchKey)
+		for _, recentAction := range recent {
+			if filter != nil {
+				recentAction = filter(recentAction)
+			}
+			c.sendAction(c.withQueryMeta(recentAction))
+		}
+	} else {
+		log.Debugf("Sending our current %s list", watchKey)
+		initialAction := &Action{Type: actionEvent, Payload: initialPayload, Index: 0}
+		if filter != nil {
+			initialAction = filter(initialAction)
+		}
+		c.sendAction(initialAction)
+	}
+
+	// pending holds the latest update a lagging connection couldn't take yet, which is retried
+	// every consulLagRetryInterval instead of blocking the broadcast
+	var pending *Action
+	var lagRetry <-chan time.Time
+
+	log.Debugf("Started watching %s", watchKey)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-stream.Changes():
+			// advance to next value
+			stream.Next()
+
+			channelAction := stream.Value().(*Action)
+			log.Debugf("got new data for %s (WaitIndex: %d)", watchKey, channelAction.Index)
+
+			if !c.watching(ctx, watchKey) {
+				log.Infof("Connection is no longer subscribed to %s", watchKey)
+				return
+			}
+
+			if channelAction.Type != actionEvent {
+				log.Debugf("Type mismatch: %s <> %s", channelAction.Type, actionEvent)
+				continue
+			}
+
+			if filter != nil {
+				channelAction = filter(channelAction)
+			}
+			channelAction = c.withQueryMeta(channelAction)
+
+			c.recordWatchSuccess(watchKey, channelAction.Index)
+
+			// a lagging connection only needs the latest list, so it replaces the pending one
+			if pending != nil {
+				log.Debugf("Connection is still lagging, replacing the pending %s update", watchKey)
+				atomic.AddUint64(&consulMetrics.broadcastsSkipped, 1)
+				pending = channelAction
+				continue
+			}
+
+			log.Debugf("Publishing change %s %s", channelAction.Type, watchKey)
+			if c.trySendAction(channelAction) {
+				c.recordWatchBroadcast(watchKey, channelAction)
+				continue
+			}
+
+			log.Warningf("Send buffer full, connection is lagging behind %s", watchKey)
+			atomic.AddUint64(&consulMetrics.broadcastsSkipped, 1)
+			pending = channelAction
+			lagRetry = time.After(consulLagRetryInterval)
+
+		case <-lagRetry:
+			resync := *pending
+			resync.Resync = true
+
+			if !c.trySendAction(&resync) {
+				lagRetry = time.After(consulLagRetryInterval)
+				continue
+			}
+
+			log.Infof("Connection caught up with %s, sent a resync", watchKey)
+			c.recordWatchBroadcast(watchKey, &resync)
+			pending = nil
+			lagRetry = nil
+		}
+	}
+}
+
+// watchConsulServices streams the services broadcast, optionally limited to the services
+// having the tag given as payload (either the plain tag, or an object with a tag and a
+// sinceIndex). Changing the tag of a running watch re-seeds the connection with the filtered list.
+func (c *ConsulConnection) watchConsulServices(action Action) {
+	var tag string
+	switch params := action.Payload.(type) {
+	case string:
+		tag = params
+	case map[string]interface{}:
+		tag, _ = params["tag"].(string)
+	}
+
+	c.lock.Lock()
+	c.serviceTag = tag
+	c.lock.Unlock()
+
+	if c.watches.Has("services") {
+		c.Infof("Changing services tag filter to %q", tag)
+		if services := c.cachedServices(); services != nil {
+			c.sendAction(c.filterServices(&Action{Type: fetchedConsulServices, Payload: services, Index: 0}))
+		}
+		return
+	}
+
+	if c.scoped() {
+		c.watchRemoteServices(action.Index)
+		return
+	}
+
+	c.watchGenericBroadcast("services", fetchedConsulServices, c.region.broadcastChannels.services, c.region.broadcastChannels.servicesHistory, c.region.services, action.Index, c.filterServices)
+}
+
+// watchConsulServicesMultiRegion streams the services broadcast of each of the regions given as
+// payload, so a single connection can show the services of several datacenters. Every region is
+// its own watch, and its actions carry the region name.
+func (c *ConsulConnection) watchConsulServicesMultiRegion(action Action) {
+	regions, ok := action.Payload.([]string)
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	for _, name := range regions {
+		region, ok := c.hub.region(name)
+		if !ok {
+			c.Warningf("Region was not found: %s", name)
+			c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to watch the services of %s - unknown region", name)})
+			continue
+		}
+
+		name := name
+		c.startWatch(func() {
+			c.watchGenericBroadcast(consulServicesRegionKey(name), fetchedConsulServices, region.broadcastChannels.services, region.broadcastChannels.servicesHistory, region.services, 0, func(action *Action) *Action {
+				return &Action{Type: fetchedConsulServicesMultiRegion, Payload: action.Payload, Index: action.Index, Meta: action.Meta, Region: name}
+			})
+		})
+	}
+}
+
+func (c *ConsulConnection) unwatchConsulServicesMultiRegion(action Action) {
+	regions, ok := action.Payload.([]string)
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	for _, name := range regions {
+		c.unwatchGenericBroadcast(consulServicesRegionKey(name))
+	}
+}
+
+// consulServiceHealthUpdate is the latest health of one of the services of a group watch, or of
+// the service in one of the datacenters of an all datacenters watch. Only err is set when the
+// query failed.
+type consulServiceHealthUpdate struct {
+	service    string
+	datacenter string
+	index      uint64
+	entries    []*api.ServiceEntry
+	err        error
+}
+
+// watchConsulServiceGroup watches the health of each of the services given as payload, and sends
+// them together keyed by service name, once every service was fetched and then on every change.
+// The per-service watches all stop with the group, so it is a single watch for the client.
+func (c *ConsulConnection) watchConsulServiceGroup(action Action) {
+	names, ok := action.Payload.([]string)
+	if !ok || len(names) == 0 {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	if len(names) > maxConsulServiceGroup {
+		c.Warningf("Refusing service group of %d services", len(names))
+		c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to watch the service group - at most %d services can be grouped", maxConsulServiceGroup)})
+		return
+	}
+
+	key := consulServiceGroupKey(names)
+	log := c.log.With("watch", key)
+
+	if c.watches.Has(key) {
+		log.Warningf("Connection is already subscribed to %s", key)
+		c.sendWatchEvent(consulWatchStarted, key, true)
+		return
+	}
+
+	ctx := c.watchContext()
+	defer c.stopWatch(ctx, key)
+	c.addWatch(ctx, key)
+	c.sendWatchEvent(consulWatchStarted, key, false)
+
+	log.Infof("Started watching %s", key)
+
+	// the first service noticing the group was unwatched stops all the others
+	groupCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	updates := make(chan consulServiceHealthUpdate)
+	for _, name := range names {
+		name := name
+		c.hub.routines.Add(1)
+		go func() {
+			defer c.hub.routines.Done()
+			defer cancel()
+			c.watchConsulServiceHealth(groupCtx, key, name, "", updates)
+		}()
+	}
+
+	group := make(map[string]*ConsulServiceGroupHealth, len(names))
+	var index uint64
+	for {
+		select {
+		case <-groupCtx.Done():
+			return
+
+		case update := <-updates:
+			// the last known health of a failing service is kept, retryWatch notifies the client
+			if update.err != nil {
+				continue
+			}
+
+			group[update.service] = newConsulServiceGroupHealth(update.entries)
+			if update.index > index {
+				index = update.index
+			}
+
+			// a partial group would show the missing services as gone
+			if len(group) < len(names) {
+				continue
+			}
+
+			payload := make(map[string]*ConsulServiceGroupHealth, len(group))
+			for name, health := range group {
+				payload[name] = health
+			}
+
+			c.recordWatchSuccess(key, index)
+			c.sendWatchAction(key, &Action{Type: fetchedConsulServiceGroup, Payload: payload, Index: index})
+		}
+	}
+}
+
+// watchConsulServiceHealth runs the blocking health query of a service in a datacenter (the
+// connection one when empty) on behalf of the watch key, until ctx is done or the key unwatched.
+// The updates of several services are merged by the caller, the key bookkeeping of
+// watchBlockingQuery is done there too, so the loop is its own, with the same index handling.
+func (c *ConsulConnection) watchConsulServiceHealth(ctx context.Context, key string, service string, datacenter string, updates chan<- consulServiceHealthUpdate) {
+	queryOptions := func(waitIndex uint64, waitTime time.Duration) *api.QueryOptions {
+		q := c.queryOptions(waitIndex, waitTime)
+		if datacenter != "" {
+			q.Datacenter = datacenter
+		}
+		return q
+	}
+
+	q := queryOptions(0, 0)
+	retry := newBackoff(watchRetryMin, watchRetryMax)
+	var lastUpdate time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		default:
+			started := time.Now()
+			entries, meta, err := c.client().Health().Service(service, "", false, q)
+			if err != nil {
+				c.log.With("watch", key).Errorf("connection: unable to fetch service %s (datacenter %q): %s", service, datacenter, err)
+
+				select {
+				case <-ctx.Done():
+					return
+				case updates <- consulServiceHealthUpdate{service: service, datacenter: datacenter, err: err}:
+				}
+
+				c.retryWatch(ctx, key, err, retry)
+				q = queryOptions(0, 0)
+				continue
+			}
+			retry.Reset()
+
+			if !c.watching(ctx, key) {
+				return
+			}
+
+			remoteWaitIndex := meta.LastIndex
+			localWaitIndex := q.WaitIndex
+
+			// the index went backwards (e.g. after a Consul server restart), start over
+			if remoteWaitIndex < localWaitIndex {
+				q = queryOptions(1, 0)
+				continue
+			}
+
+			q = queryOptions(remoteWaitIndex, c.region.Config.ConsulWaitTime)
+			if remoteWaitIndex == localWaitIndex {
+				if !c.waitIfIdle(ctx, started) {
+					return
+				}
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case updates <- consulServiceHealthUpdate{service: service, datacenter: datacenter, index: remoteWaitIndex, entries: entries}:
+			}
+
+			c.throttle(ctx, &lastUpdate)
+		}
+	}
+}
+
+// consulServiceGroupKey is the watch key of a service group, the same for any order of the names
+func consulServiceGroupKey(names []string) string {
+	sorted := make([]string, len(names))
+	copy(sorted, names)
+	sort.Strings(sorted)
+
+	return "consul/services/group?names=" + strings.Join(sorted, ",")
+}
+
+// watchConsulServiceAllDC watches the health of the service given as payload in every datacenter,
+// and sends them together keyed by datacenter. A datacenter failing to answer is marked as
+// unreachable, with the last health known for it, and retried without stopping the others.
+func (c *ConsulConnection) watchConsulServiceAllDC(action Action) {
+	service, ok := c.stringPayload(action)
+	if !ok || service == "" {
+		return
+	}
+
+	key := consulServiceAllDCKey(service)
+	log := c.log.With("watch", key)
+
+	if c.watches.Has(key) {
+		log.Warningf("Connection is already subscribed to %s", key)
+		c.sendWatchEvent(consulWatchStarted, key, true)
+		return
+	}
+
+	ctx := c.watchContext()
+	defer c.stopWatch(ctx, key)
+	c.addWatch(ctx, key)
+	c.sendWatchEvent(consulWatchStarted, key, false)
+
+	datacenters, err := c.requestClient().Catalog().Datacenters()
+	if err != nil {
+		log.Errorf("connection: unable to fetch consul datacenters: %s", err)
+		c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to watch %s in all datacenters - the datacenters are unknown: %s", service, err)})
+		return
+	}
+
+	if len(datacenters) > maxConsulServiceGroup {
+		log.Warningf("Watching %s in the first %d of %d datacenters", service, maxConsulServiceGroup, len(datacenters))
+		datacenters = datacenters[:maxConsulServiceGroup]
+	}
+
+	log.Infof("Started watching %s in %d datacenters", service, len(datacenters))
+
+	// the first datacenter noticing the watch was stopped stops all the others
+	serviceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	updates := make(chan consulServiceHealthUpdate)
+	for _, datacenter := range datacenters {
+		datacenter := datacenter
+		c.hub.routines.Add(1)
+		go func() {
+			defer c.hub.routines.Done()
+			defer cancel()
+			c.watchConsulServiceHealth(serviceCtx, key, service, datacenter, updates)
+		}()
+	}
+
+	health := make(map[string]*ConsulServiceDatacenterHealth, len(datacenters))
+	var index uint64
+	for {
+		select {
+		case <-serviceCtx.Done():
+			return
+
+		case update := <-updates:
+			if update.err != nil {
+				last, ok := health[update.datacenter]
+				if !ok {
+					last = &ConsulServiceDatacenterHealth{ConsulServiceGroupHealth: newConsulServiceGroupHealth(make([]*api.ServiceEntry, 0))}
+				}
+				health[update.datacenter] = &ConsulServiceDatacenterHealth{ConsulServiceGroupHealth: last.ConsulServiceGroupHealth, Error: update.err.Error()}
+			} else {
+				health[update.datacenter] = &ConsulServiceDatacenterHealth{ConsulServiceGroupHealth: newConsulServiceGroupHealth(update.entries), Reachable: true}
+				if update.index > index {
+					index = update.index
+				}
+			}
+
+			// a partial list would show the missing datacenters as not running the service
+			if len(health) < len(datacenters) {
+				continue
+			}
+
+			payload := &ConsulServiceAllDC{Service: service, Datacenters: make(map[string]*ConsulServiceDatacenterHealth, len(health))}
+			for datacenter, dcHealth := range health {
+				payload.Datacenters[datacenter] = dcHealth
+			}
+
+			c.recordWatchSuccess(key, index)
+			c.sendWatchAction(key, &Action{Type: fetchedConsulServiceAllDC, Payload: payload, Index: index})
+		}
+	}
+}
+
+// consulServiceAllDCKey is the watch key of a service in all datacenters
+func consulServiceAllDCKey(service string) string {
+	return "consul/service/all-dc?" + service
+}
+
+// consulServicesRegionKey is the watch key of the services broadcast of another region
+func consulServicesRegionKey(region string) string {
+	return "services?region=" + region
+}
+
+// filterServices limits a services action to the services having the connection tag filter
+func (c *ConsulConnection) filterServices(action *Action) *Action {
+	c.lock.RLock()
+	tag := c.serviceTag
+	c.lock.RUnlock()
+
+	if tag == "" {
+		return action
+	}
+
+	var services ConsulInternalServices
+	switch payload := action.Payload.(type) {
+	case ConsulInternalServices:
+		services = payload
+	case *ConsulInternalServices:
+		services = *payload
+	default:
+		return action
+	}
+
+	filtered := make(ConsulInternalServices, 0)
+	for _, service := range services {
+		for _, serviceTag := range service.Tags {
+			if serviceTag == tag {
+				filtered = append(filtered, service)
+				break
+			}
+		}
+	}
+
+	return &Action{Type: action.Type, Payload: filtered, Index: action.Index, Meta: action.Meta}
+}
+
+// refreshWatch re-sends the current cached list of a broadcast watch (services or nodes) with
+// Index 0, so the UI can re-seed its state without re-subscribing.
+func (c *ConsulConnection) refreshWatch(action Action) {
+	watchKey, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+
+	if !c.watches.Has(watchKey) {
+		c.Warningf("Connection is not subscribed to %s, not refreshing", watchKey)
+		return
+	}
+
+	switch watchKey {
+	case "services":
+		if services := c.cachedServices(); services != nil {
+			c.sendAction(c.filterServices(&Action{Type: fetchedConsulServices, Payload: services, Index: 0}))
+		}
+	case "nodes":
+		if nodes := c.cachedNodes(); nodes != nil {
+			c.sendAction(c.filterNodes(&Action{Type: fetchedConsulNodes, Payload: nodes, Index: 0}))
+		}
+	default:
+		c.Warningf("Watch %s has no cached value to refresh", watchKey)
+	}
+}
+
+// watchConsulNodes streams the nodes broadcast. When the payload is an object with withHealth
+// set, every node carries the aggregated status of its checks, so the UI doesn't need a watch
+// per node to color them. A meta object (e.g. {"rack": "1"}) limits the stream to the nodes
+// having all of the given node meta values. Changing the filters of a running watch re-seeds
+// the connection with the filtered list.
+func (c *ConsulConnection) watchConsulNodes(action Action) {
+	params, _ := action.Payload.(map[string]interface{})
+	withHealth, _ := params["withHealth"].(bool)
+
+	var meta map[string]string
+	if rawMeta, ok := params["meta"].(map[string]interface{}); ok && len(rawMeta) > 0 {
+		meta = make(map[string]string, len(rawMeta))
+		for key, value := range rawMeta {
+			meta[key] = fmt.Sprint(value)
+		}
+	}
+
+	c.lock.Lock()
+	c.nodesWithHealth = withHealth
+	c.nodesMeta = meta
+	c.lock.Unlock()
+
+	if c.watches.Has("nodes") {
+		c.Infof("Changing nodes meta filter to %v", meta)
+		if nodes := c.cachedNodes(); nodes != nil {
+			c.sendAction(c.filterNodes(&Action{Type: fetchedConsulNodes, Payload: nodes, Index: 0}))
+		}
+		return
+	}
+
+	if c.scoped() {
+		c.watchRemoteNodes(action.Index)
+		return
+	}
+
+	c.watchGenericBroadcast("nodes", fetchedConsulNodes, c.region.broadcastChannels.nodes, c.region.broadcastChannels.nodesHistory, c.region.nodes, action.Index, c.filterNodes)
+}
+
+// watchRemoteServices streams the services of the remote datacenter of the connection, as the
+// region does for its own datacenter, but with the connection blocking queries
+func (c *ConsulConnection) watchRemoteServices(sinceIndex uint64) {
+	raw := c.client().Raw()
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		var services ConsulInternalServices
+		meta, err := raw.Query("/v1/internal/ui/services", &services, q)
+		if err != nil {
+			return nil, meta, err
+		}
+
+		// the internal UI endpoint doesn't include tags, add them from the catalog
+		catalog, _, err := c.client().Catalog().Services(c.queryOptions(0, 0))
+		if err != nil {
+			c.Errorf("connection: unable to fetch service tags: %s", err)
+		} else {
+			for _, service := range services {
+				service.Tags = catalog[service.Name]
+			}
+		}
+
+		c.lock.Lock()
+		c.remoteServices = &services
+		c.lock.Unlock()
+
+		return services, meta, nil
+	}
+
+	c.watchBlockingQuery("services", sinceIndex, query, func(payload interface{}) *Action {
+		return c.filterServices(&Action{Type: fetchedConsulServices, Payload: payload})
+	})
+}
+
+// watchRemoteNodes streams the nodes of the remote datacenter of the connection
+func (c *ConsulConnection) watchRemoteNodes(sinceIndex uint64) {
+	raw := c.client().Raw()
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		var nodes ConsulInternalNodes
+		meta, err := raw.Query("/v1/internal/ui/nodes", &nodes, q)
+		if err != nil {
+			return nil, meta, err
+		}
+
+		c.lock.Lock()
+		c.remoteNodes = &nodes
+		c.lock.Unlock()
+
+		return nodes, meta, nil
+	}
+
+	c.watchBlockingQuery("nodes", sinceIndex, query, func(payload interface{}) *Action {
+		return c.filterNodes(&Action{Type: fetchedConsulNodes, Payload: payload})
+	})
+}
+
+// filterNodes limits a nodes action to the nodes matching the connection meta filter, and
+// joins them with their health if asked for
+func (c *ConsulConnection) filterNodes(action *Action) *Action {
+	return c.addNodesHealth(c.filterNodesMeta(action))
+}
+
+// filterNodesMeta limits a nodes action to the nodes having all of the connection meta values
+func (c *ConsulConnection) filterNodesMeta(action *Action) *Action {
+	c.lock.RLock()
+	meta := c.nodesMeta
+	c.lock.RUnlock()
+
+	if len(meta) == 0 {
+		return action
+	}
+
+	var nodes ConsulInternalNodes
+	switch payload := action.Payload.(type) {
+	case ConsulInternalNodes:
+		nodes = payload
+	case *ConsulInternalNodes:
+		nodes = *payload
+	default:
+		return action
+	}
+
+	filtered := make(ConsulInternalNodes, 0)
+	for _, node := range nodes {
+		matches := true
+		for key, value := range meta {
+			if node.Meta[key] != value {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			filtered = append(filtered, node)
+		}
+	}
+
+	return &Action{Type: action.Type, Payload: filtered, Index: action.Index, Meta: action.Meta}
+}
+
+// addNodesHealth joins the nodes of a nodes action with their aggregated health, if the
+// connection asked for it
+func (c *ConsulConnection) addNodesHealth(action *Action) *Action {
+	c.lock.RLock()
+	withHealth := c.nodesWithHealth
+	c.lock.RUnlock()
+
+	if !withHealth {
+		return action
+	}
+
+	var nodes ConsulInternalNodes
+	switch payload := action.Payload.(type) {
+	case ConsulInternalNodes:
+		nodes = payload
+	case *ConsulInternalNodes:
+		nodes = *payload
+	default:
+		return action
+	}
+
+	enriched := make([]*ConsulNodeHealth, 0, len(nodes))
+	for _, node := range nodes {
+		enriched = append(enriched, &ConsulNodeHealth{ConsulInternalNode: node, Health: node.aggregatedHealth()})
+	}
+
+	return &Action{Type: action.Type, Payload: enriched, Index: action.Index, Meta: action.Meta}
+}
+
+// watchConsulHealthSummary streams the service, instance, node and check counts of the region.
+// They are derived from the services and nodes broadcasts, so no extra queries are made.
+func (c *ConsulConnection) watchConsulHealthSummary() {
+	key := "consul/health/summary"
+
+	if c.watches.Has(key) {
+		c.Warningf("Connection is already subscribed to %s", key)
+		c.sendWatchEvent(consulWatchStarted, key, true)
+		return
+	}
+
+	ctx := c.watchContext()
+	defer c.stopWatch(ctx, key)
+	c.addWatch(ctx, key)
+	c.sendWatchEvent(consulWatchStarted, key, false)
+
+	c.Infof("Started watching %s", key)
+
+	services := c.region.broadcastChannels.services.Observe()
+	nodes := c.region.broadcastChannels.nodes.Observe()
+
+	var lastUpdate time.Time
+	var lastChecksum uint64
+	for {
+		summary := c.region.healthSummary()
+		if c.payloadChanged(summary, &lastChecksum) {
+			c.sendAction(&Action{Type: fetchedConsulHealthSummary, Payload: summary})
+			c.throttle(ctx, &lastUpdate)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-services.Changes():
+			services.Next()
+
+		case <-nodes.Changes():
+			nodes.Next()
+		}
+
+		if !c.watching(ctx, key) {
+			return
+		}
+	}
+}
+
+func (c *ConsulConnection) unwatchGenericBroadcast(watchKey string) {
+	c.Debugf("Removing subscription for %s", watchKey)
+	c.watches.Remove(watchKey)
+}
+
+// consulServiceWatch decodes the payload of a (un)watch service action. The payload is either
+// the service name, or an object with a serviceID and optional tag and passingOnly filters.
+// The returned key identifies the watch, and is the plain service name when no filter is set.
+func consulServiceWatch(payload interface{}) (serviceID, tag string, passingOnly bool, key string) {
+	switch params := payload.(type) {
+	case string:
+		serviceID = params
+	case map[string]interface{}:
+		serviceID, _ = params["serviceID"].(string)
+		tag, _ = params["tag"].(string)
+		passingOnly, _ = params["passingOnly"].(bool)
+	}
+
+	key = serviceID
+	if tag != "" || passingOnly {
+		key = fmt.Sprintf("consul/service/%s?tag=%s&passingOnly=%t", serviceID, tag, passingOnly)
+	}
+
+	return serviceID, tag, passingOnly, key
+}
+
+func (c *ConsulConnection) watchConsulService(action Action) {
+	serviceID, tag, passingOnly, key := consulServiceWatch(action.Payload)
+	if serviceID == "" {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	// the raw query keeps the service fields the vendored ServiceEntry has no room for, but can't
+	// pass the tag and passing parameters, which are applied here instead
+	raw := c.client().Raw()
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		var entries []*ConsulServiceEntry
+		meta, err := raw.Query(fmt.Sprintf("/v1/health/service/%s", serviceID), &entries, q)
+		if err != nil {
+			return nil, meta, err
+		}
+
+		return entries, meta, nil
+	}
+
+	c.watchBlockingQuery(key, action.Index, query, func(payload interface{}) *Action {
+		// let the UI tell a deregistered service apart from one without data yet. Only a
+		// service without any instance is gone, the filters may well exclude all of them.
+		entries := payload.([]*ConsulServiceEntry)
+		if len(entries) == 0 {
+			return &Action{Type: consulServiceGone, Payload: serviceID}
+		}
+
+		return &Action{Type: fetchedConsulService, Payload: filterServiceEntries(entries, tag, passingOnly)}
+	})
+}
+
+// filterServiceEntries keeps the entries having the tag (any when empty) and, with passingOnly,
+// those whose checks all pass, as the tag and passing parameters of the health endpoint do
+func filterServiceEntries(entries []*ConsulServiceEntry, tag string, passingOnly bool) []*ConsulServiceEntry {
+	filtered := make([]*ConsulServiceEntry, 0, len(entries))
+
+entries:
+	for _, entry := range entries {
+		if entry.Service == nil {
+			continue
+		}
+
+		if tag != "" {
+			tagged := false
+			for _, serviceTag := range entry.Service.Tags {
+				if serviceTag == tag {
+					tagged = true
+					break
+				}
+			}
+
+			if !tagged {
+				continue
+			}
+		}
+
+		if passingOnly {
+			for _, check := range entry.Checks {
+				if check.Status != api.HealthPassing {
+					continue entries
+				}
+			}
+		}
+
+		filtered = append(filtered, entry)
+	}
+
+	return filtered
+}
+
+func (c *ConsulConnection) watchConsulNode(action Action) {
+	nodeID, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+	key := "consul/node/" + nodeID
+
+	raw := c.client().Raw()
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		var node ConsulInternalNode
+		meta, err := raw.Query(fmt.Sprintf("/v1/internal/ui/node/%s", nodeID), &node, q)
+		return node, meta, err
+	}
+
+	c.watchBlockingQuery(key, action.Index, query, func(payload interface{}) *Action {
+		// let the UI tell a deregistered node apart from one without data yet
+		if node := payload.(ConsulInternalNode); node.Node == "" {
+			return &Action{Type: consulNodeGone, Payload: nodeID}
+		}
+
+		return &Action{Type: fetchedConsulNode, Payload: payload}
+	})
+}
+
+// watchConsulConnectServices streams the Connect proxies and gateways, and the services using
+// them. The catalog services endpoint only has names and tags, so they are taken from the UI
+// services endpoint which includes the service kind.
+func (c *ConsulConnection) watchConsulConnectServices(action Action) {
+	raw := c.client().Raw()
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		var services []*ConsulConnectService
+		meta, err := raw.Query("/v1/internal/ui/services", &services, q)
+		if err != nil {
+			return nil, meta, err
+		}
+
+		connect := make([]*ConsulConnectService, 0)
+		for _, service := range services {
+			if service.Kind != "" || service.ConnectedWithProxy || service.ConnectedWithGateway {
+				connect = append(connect, service)
+			}
+		}
+
+		return connect, meta, nil
+	}
+
+	c.watchBlockingQuery("consul/connect/services", action.Index, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulConnectServices, Payload: payload}
+	})
+}
+
+// watchConsulNodeServices streams the service registrations of a node, where watchConsulNode
+// streams its health checks
+func (c *ConsulConnection) watchConsulNodeServices(action Action) {
+	nodeName, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		node, meta, err := c.client().Catalog().Node(nodeName, q)
+		if err != nil {
+			return nil, meta, err
+		}
+
+		result := ConsulNodeServices{Node: nodeName, Services: make([]*api.AgentService, 0)}
+		if node == nil {
+			return result, meta, nil
+		}
+
+		ids := make([]string, 0, len(node.Services))
+		for id := range node.Services {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			result.Services = append(result.Services, node.Services[id])
+		}
+
+		return result, meta, nil
+	}
+
+	c.watchBlockingQuery(consulNodeServicesKey(nodeName), action.Index, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulNodeServices, Payload: payload}
+	})
+}
+
+// consulNodeServicesKey is the watch key of the services of a node
+func consulNodeServicesKey(nodeName string) string {
+	return "consul/node/" + nodeName + "/services"
+}
+
+// watchConsulChecksInState streams the health checks in a given state. With a coalescing window,
+// a change is sent at most once per window, as the state at the end of the window, so flapping
+// checks on a large cluster don't flood the client.
+func (c *ConsulConnection) watchConsulChecksInState(action Action) {
+	params, ok := action.Payload.(*ConsulChecksInStatePayload)
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+	state := params.State
+	key := "consul/checks/state?" + state
+
+	window := time.Duration(params.Window) * time.Millisecond
+	if window < 0 || window > maxThrottleInterval {
+		c.Warningf("Ignoring coalescing window of %dms", params.Window)
+		window = 0
+	}
+
+	switch state {
+	case api.HealthAny, api.HealthPassing, api.HealthWarning, api.HealthCritical:
+	default:
+		c.Errorf("Invalid health check state: %s", state)
+		c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Invalid health check state: %s", state)})
+		return
+	}
+
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		checks, meta, err := c.client().Health().State(state, q)
+		if checks == nil {
+			checks = api.HealthChecks{}
+		}
+
+		return checks, meta, err
+	}
+
+	c.watchCoalescedQuery(key, action.Index, window, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulChecksInState, Payload: payload}
+	})
+}
+
+// watchConsulServiceChecks streams every health check (node and service level) of the
+// instances of a service, including their output. Unlike watchConsulService it sends the
+// raw checks rather than the service entries they are aggregated in.
+func (c *ConsulConnection) watchConsulServiceChecks(action Action) {
+	serviceName, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		checks, meta, err := c.client().Health().Checks(serviceName, q)
+		if checks == nil {
+			checks = api.HealthChecks{}
+		}
+
+		return checks, meta, err
+	}
+
+	c.watchBlockingQuery("consul/service/checks?"+serviceName, action.Index, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulServiceChecks, Payload: payload}
+	})
+}
+
+func (c *ConsulConnection) watchConsulIntentions(action Action) {
+	raw := c.client().Raw()
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		intentions := make([]*ConsulIntention, 0)
+		meta, err := raw.Query("/v1/connect/intentions", &intentions, q)
+		return intentions, meta, err
+	}
+
+	c.watchBlockingQuery("consul/intentions", action.Index, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulIntentions, Payload: payload}
+	})
+}
+
+func (c *ConsulConnection) createConsulIntention(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to create Consul intention: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to create Consul intention - the Consul backend is set to read-only"})
+		return
+	}
+
+	params, ok := action.Payload.(*ConsulIntentionPayload)
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	source := params.Source
+	destination := params.Destination
+	intentionAction := params.Action
+
+	if source == "" || destination == "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to create Consul intention - missing source or destination"})
+		return
+	}
+
+	if intentionAction != "allow" && intentionAction != "deny" {
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to create Consul intention - invalid action: %s", intentionAction)})
+		return
+	}
+
+	intention := &ConsulIntention{SourceName: source, DestinationName: destination, Action: intentionAction}
+	intention.Description = params.Description
+
+	var result struct{ ID string }
+	if err := c.region.rawRequest(c.ctx, "POST", "/v1/connect/intentions", c.remoteDatacenter(), c.remoteNamespace(), c.aclToken(), intention, &result); err != nil {
+		logger.Errorf("connection: unable to create consul intention %s => %s: %s", source, destination, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to create intention %s => %s: %s", source, destination, err)})
+		return
+	}
+
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The intention was successfully created: %s", result.ID)})
+}
+
+func (c *ConsulConnection) deleteConsulIntention(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to delete Consul intention: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to delete Consul intention - the Consul backend is set to read-only"})
+		return
+	}
+
+	intentionID, ok := action.Payload.(string)
+	if !ok || intentionID == "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to delete Consul intention - missing intention id"})
+		return
+	}
+
+	if err := c.region.rawRequest(c.ctx, "DELETE", "/v1/connect/intentions/"+intentionID, c.remoteDatacenter(), c.remoteNamespace(), c.aclToken(), nil, nil); err != nil {
+		logger.Errorf("connection: unable to delete consul intention '%s': %s", intentionID, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to delete intention %s: %s", intentionID, err)})
+		return
+	}
+
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The intention was successfully deleted: %s", intentionID)})
+}
+
+func (c *ConsulConnection) watchConsulKVPath(action Action) {
+	path, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		return c.client().KV().Keys(path, "/", q)
+	}
+
+	c.watchBlockingQuery("consul/kv/path?"+path, action.Index, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulKVPath, Payload: payload}
+	})
+}
+
+// watchConsulLocks streams the keys below the prefix given as payload that are held by a session,
+// along with that session, to see who holds the locks and semaphore slots of an application
+func (c *ConsulConnection) watchConsulLocks(action Action) {
+	prefix, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		pairs, meta, err := c.client().KV().List(prefix, q)
+		if err != nil {
+			return nil, meta, err
+		}
+
+		locks := make([]*ConsulLock, 0)
+		for _, pair := range pairs {
+			if pair.Session != "" {
+				locks = append(locks, &ConsulLock{Key: pair.Key, LockIndex: pair.LockIndex, Flags: pair.Flags, SessionID: pair.Session})
+			}
+		}
+
+		if len(locks) == 0 {
+			return locks, meta, nil
+		}
+
+		sessions, _, err := c.client().Session().List(c.queryOptions(0, 0))
+		if err != nil {
+			return nil, meta, err
+		}
+
+		byID := make(map[string]*api.SessionEntry, len(sessions))
+		for _, session := range sessions {
+			byID[session.ID] = session
+		}
+
+		for _, lock := range locks {
+			lock.Session = byID[lock.SessionID]
+		}
+
+		return locks, meta, nil
+	}
+
+	c.watchBlockingQuery("consul/locks?"+prefix, action.Index, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulLocks, Payload: payload}
+	})
+}
+
+func (c *ConsulConnection) watchConsulKVPrefix(action Action) {
+	prefix, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		pairs, meta, err := c.client().KV().List(prefix, q)
+
+		// a missing prefix is reported as a nil list, send it as an empty one
+		if pairs == nil {
+			pairs = api.KVPairs{}
+		}
+
+		return pairs, meta, err
+	}
+
+	c.watchBlockingQuery("consul/kv/prefix?"+prefix, action.Index, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulKVPrefix, Payload: payload}
+	})
+}
+
+func (c *ConsulConnection) watchConsulKV(action Action) {
+	kvKey, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		pair, meta, err := c.client().KV().Get(kvKey, q)
+		if err != nil {
+			return nil, meta, err
+		}
+
+		// a deleted (or missing) key is still sent, with a null value
+		value := &ConsulKVPairValue{Key: kvKey}
+		if pair != nil {
+			value.Value = pair.Value
+			value.Flags = pair.Flags
+			value.ModifyIndex = pair.ModifyIndex
+		}
+
+		return value, meta, nil
+	}
+
+	c.watchBlockingQuery("consul/kv?"+kvKey, action.Index, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulKV, Payload: payload}
+	})
+}
+
+func (c *ConsulConnection) writeConsulKV(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to write Consul KV: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to write Consul KV - the Consul backend is set to read-only"})
+		return
+	}
+
+	params, ok := action.Payload.(*ConsulKVPairPayload)
+	if !ok || params.Path == "" {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	key := params.Path
+	keyPair := &api.KVPair{Key: key, Value: []byte(params.Value), ModifyIndex: params.Index}
+
+	res, _, err := c.client().KV().CAS(keyPair, c.writeOptions())
+	if err != nil {
+		logger.Errorf("connection: unable to write consul kv '%s': %s", key, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to write key %s: %s", key, err)})
+		return
+	}
+
+	if !res {
+		logger.Errorf("connection: unable to write consul kv '%s': %s", key, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to write key %s: maybe the key was modified since you loaded it?", key)})
+		return
+	}
+
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The key was successfully written: %s.", key)})
+
+	if key[len(key)-1:] != "/" {
+		// refresh data post-save
+		c.getConsulKVPair(Action{Payload: key})
+	}
+}
+
+func (c *ConsulConnection) deleteConsulKvFolder(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to delete Consul KV: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to delete Consul KV - the Consul backend is set to read-only"})
+		return
+	}
+
+	key, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+
+	_, err := c.client().KV().DeleteTree(key, c.writeOptions())
+	if err != nil {
+		logger.Errorf("connection: unable to delete consul kv '%s': %s", key, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to write key : %s", key)})
+		return
+	}
+
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The key was successfully deleted: %s.", key)})
+}
+
+func (c *ConsulConnection) setConsulKV(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to write Consul KV: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to write Consul KV - the Consul backend is set to read-only"})
+		return
+	}
+
+	params, ok := action.Payload.(*ConsulKVPayload)
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	key := params.Key
+	if key == "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to write Consul KV - missing key"})
+		return
+	}
+
+	if params.Session != "" && params.ModifyIndex != nil {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to write Consul KV - a key can't be both acquired by a session and checked-and-set"})
+		return
+	}
+
+	pair := &api.KVPair{Key: key, Value: []byte(params.Value), Flags: params.Flags}
+	result := &ConsulKVWriteResult{Key: key, CAS: params.ModifyIndex != nil, Session: params.Session, Success: true}
+
+	var err error
+	if result.CAS {
+		pair.ModifyIndex = *params.ModifyIndex
+		result.Success, _, err = c.client().KV().CAS(pair, c.writeOptions())
+	} else if result.Session != "" {
+		pair.Session = params.Session
+		result.Success, _, err = c.client().KV().Acquire(pair, c.writeOptions())
+	} else {
+		_, err = c.client().KV().Put(pair, c.writeOptions())
+	}
+
+	if err != nil {
+		logger.Errorf("connection: unable to write consul kv '%s': %s", key, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to write key %s: %s", key, err)})
+		return
+	}
+
+	c.reply(action, &Action{Type: writtenConsulKV, Payload: result})
+
+	if !result.Success && result.Session != "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to acquire key %s: it is held by another session", key)})
+		return
+	}
+
+	if !result.Success {
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to write key %s: it was modified since you loaded it", key)})
+		return
+	}
+
+	if result.Session != "" {
+		c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The key was successfully acquired by session %s: %s.", result.Session, key)})
+		return
+	}
+
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The key was successfully written: %s.", key)})
+}
+
+// consulTxnVerbs are the KV operations a CONSUL_TXN may contain
+var consulTxnVerbs = map[string]api.KVOp{
+	"set":    api.KVSet,
+	"delete": api.KVDelete,
+	"cas":    api.KVCAS,
+}
+
+// consulTxn applies a list of KV operations atomically, either all of them are or none is
+func (c *ConsulConnection) consulTxn(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to run Consul transaction: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to run Consul transaction - the Consul backend is set to read-only"})
+		return
+	}
+
+	params, ok := action.Payload.(*ConsulTxnPayload)
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	if len(params.Ops) == 0 {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to run Consul transaction - no operations given"})
+		return
+	}
+
+	ops := make(api.KVTxnOps, 0, len(params.Ops))
+	for i, op := range params.Ops {
+		verb, ok := consulTxnVerbs[op.Verb]
+		if !ok || op.Key == "" {
+			c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to run Consul transaction - operation %d is not a set, delete or cas of a key", i)})
+			return
+		}
+
+		ops = append(ops, &api.KVTxnOp{Verb: verb, Key: op.Key, Value: []byte(op.Value), Index: op.Index})
+	}
+
+	success, response, _, err := c.client().KV().Txn(ops, c.queryOptions(0, 0))
+	if err != nil {
+		logger.Errorf("connection: unable to run consul transaction: %s", err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to run Consul transaction: %s", err)})
+		return
+	}
+
+	result := &ConsulTxnResult{Success: success, Results: response.Results, Errors: response.Errors}
+	c.reply(action, &Action{Type: completedConsulTxn, Payload: result})
+
+	if !success {
+		whats := make([]string, 0, len(response.Errors))
+		for _, txnErr := range response.Errors {
+			whats = append(whats, fmt.Sprintf("operation %d: %s", txnErr.OpIndex, txnErr.What))
+		}
+
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("The Consul transaction was rolled back (%s)", strings.Join(whats, ", "))})
+		return
+	}
+
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The %d operations were applied", len(ops))})
+}
+
+// deleteConsulKVTree recursively deletes every key below a prefix. The prefix has to be given
+// explicitly, an empty one (or just "/") would wipe the whole KV store and is refused.
+func (c *ConsulConnection) deleteConsulKVTree(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to delete Consul KV tree: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to delete Consul KV tree - the Consul backend is set to read-only"})
+		return
+	}
+
+	params, ok := action.Payload.(*ConsulKVTreePayload)
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	prefix := params.Prefix
+	if strings.Trim(prefix, "/") == "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to delete Consul KV tree - refusing to delete without a prefix"})
+		return
+	}
+
+	if _, err := c.client().KV().DeleteTree(prefix, c.writeOptions()); err != nil {
+		logger.Errorf("connection: unable to delete consul kv tree '%s': %s", prefix, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to delete tree %s: %s", prefix, err)})
+		return
+	}
+
+	c.reply(action, &Action{Type: deletedConsulKVTree, Payload: &ConsulKVTreeDeleted{Prefix: prefix, Recursive: true}})
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("All keys below %s were successfully deleted", prefix)})
+}
+
+func (c *ConsulConnection) deleteConsulKV(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to delete Consul KV: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to delete Consul KV - the Consul backend is set to read-only"})
+		return
+	}
+
+	key, ok := action.Payload.(string)
+	if !ok || key == "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to delete Consul KV - missing key"})
+		return
+	}
+
+	_, err := c.client().KV().Delete(key, c.writeOptions())
+	if err != nil {
+		logger.Errorf("connection: unable to delete consul kv '%s': %s", key, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to delete key %s: %s", key, err)})
+		return
+	}
+
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The key was successfully deleted: %s.", key)})
+}
+
+func (c *ConsulConnection) getConsulKVPair(action Action) {
+	key, ok := c.stringPayload(action)
+	if !ok {
+		return
+	}
+
+	pair, _, err := c.requestClient().KV().Get(key, c.queryOptions(0, 0))
+	if err != nil {
+		logger.Errorf("connection: unable to get consul kv '%s': %s", key, err)
+		c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to read key : %s", key)})
+		return
+	}
+
+	if pair == nil {
+		c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to read key : %s", key)})
+		return
+	}
+
+	c.sendAction(&Action{Type: fetchedConsulKVPair, Payload: pair, Index: pair.ModifyIndex})
+}
+
+func (c *ConsulConnection) deleteConsulKvPair(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to delete Consul KV: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to delete Consul KV - the Consul backend is set to read-only"})
+		return
+	}
+
+	params, ok := action.Payload.(*ConsulKVPairPayload)
+	if !ok || params.Path == "" {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	key := params.Path
+	keyPair := &api.KVPair{Key: key, ModifyIndex: params.Index}
+
+	success, _, err := c.client().KV().DeleteCAS(keyPair, c.writeOptions())
+	if err != nil {
+		logger.Errorf("connection: unable to get consul kv '%s': %s", key, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to delete key %s: %s", key, err)})
+		return
+	}
+
+	if !success {
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to delete key %s", key)})
+		return
+	}
+
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("Successfully deleted %s", key)})
+	c.reply(action, &Action{Type: clearConsulKvPair})
+}
+
+// registerConsulService registers a service with the agent hashi-ui talks to. The vendored
+// client only registers with its own token, so the request is made with the connection token.
+func (c *ConsulConnection) registerConsulService(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to register Consul Service: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to register Consul Service - the Consul backend is set to read-only"})
+		return
+	}
+
+	registration, ok := action.Payload.(*api.AgentServiceRegistration)
+	if !ok {
+		c.Errorf("Could not decode payload")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to register service - invalid registration"})
+		return
+	}
+
+	if err := validateServiceRegistration(registration); err != nil {
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to register service : %s", err)})
+		return
+	}
+
+	// the agent endpoints aren't forwarded to other datacenters, the service would silently be
+	// registered in the local one
+	if datacenter := c.remoteDatacenter(); datacenter != "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to register service - services can only be registered with the agent of %s, not in %s", c.region.Datacenter, datacenter)})
+		return
+	}
+
+	if err := c.region.rawRequest(c.ctx, "PUT", "/v1/agent/service/register", "", c.remoteNamespace(), c.aclToken(), registration, nil); err != nil {
+		logger.Errorf("connection: unable to register consul service '%s': %s", registration.Name, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to register service : %s", err)})
+		return
+	}
+
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The service %s has been successfully registered.", registration.Name)})
+}
+
+// validateServiceRegistration checks what the agent would otherwise refuse with a less helpful
+// message: a service needs a name and a valid port, and every check exactly one kind of probe,
+// the probes other than TTL running on an interval
+func validateServiceRegistration(registration *api.AgentServiceRegistration) error {
+	if strings.TrimSpace(registration.Name) == "" {
+		return fmt.Errorf("the service name is required")
+	}
+
+	if registration.Port < 0 || registration.Port > 65535 {
+		return fmt.Errorf("invalid port %d", registration.Port)
+	}
+
+	checks := registration.Checks
+	if registration.Check != nil {
+		checks = append(api.AgentServiceChecks{registration.Check}, checks...)
+	}
+
+	for i, check := range checks {
+		probes := 0
+		for _, probe := range []string{check.Script, check.HTTP, check.TCP, check.TTL} {
+			if probe != "" {
+				probes++
+			}
+		}
+
+		if probes != 1 {
+			return fmt.Errorf("check %d must have exactly one of script, http, tcp or ttl", i+1)
+		}
+
+		if check.TTL == "" && check.Interval == "" {
+			return fmt.Errorf("check %d needs an interval", i+1)
+		}
+	}
+
+	return nil
+}
+
+// dereigsterConsulService removes a service instance. When the nodeAddress is known the agent on
+// that node deregisters it, when only the node name is known it's removed from the catalog, and
+// otherwise the agent hashi-ui talks to is asked to deregister it.
+func (c *ConsulConnection) dereigsterConsulService(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to deregister Consul Service: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to deresiger Consul Service - the Consul backend is set to read-only"})
+		return
+	}
+
+	var serviceID, nodeName, nodeAddress string
+
+	switch params := action.Payload.(type) {
+	case string:
+		serviceID = params
+	case map[string]interface{}:
+		serviceID, _ = params["serviceID"].(string)
+		nodeName, _ = params["node"].(string)
+		nodeAddress, _ = params["nodeAddress"].(string)
+	}
+
+	if serviceID == "" {
+		c.Errorf("Could not decode payload")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to deregister service - missing service ID"})
+		return
+	}
+
+	var err error
+
+	switch {
+	case nodeAddress != "":
+		client, clientErr := c.agentClient(nodeAddress)
+		if clientErr != nil {
+			logger.Errorf("connection: unable to create consul client : %s", clientErr)
+			c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to create Consul client : %s", clientErr)})
+			return
+		}
+
+		err = client.Agent().ServiceDeregister(serviceID)
+
+	case nodeName != "":
+		_, err = c.client().Catalog().Deregister(&api.CatalogDeregistration{Node: nodeName, ServiceID: serviceID}, c.writeOptions())
+
+	default:
+		// Agent().ServiceDeregister takes no options, and would use the token of hashi-ui instead
+		// of the connection one
+		err = c.region.rawRequest(c.ctx, "PUT", "/v1/agent/service/deregister/"+serviceID, "", c.remoteNamespace(), c.aclToken(), nil, nil)
+	}
+
+	if err != nil {
+		logger.Errorf("connection: unable to deregister consul service '%s': %s", serviceID, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to deregister service : %s", err)})
+		return
+	}
+
+	c.reply(action, &Action{Type: successNotification, Payload: "The service has been successfully deregistered."})
+}
+
+func (c *ConsulConnection) dereigsterConsulServiceCheck(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to deregister Consul Service Check: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to deresiger Consul Service Check - the Consul backend is set to read-only"})
+		return
+	}
+
+	params, ok := action.Payload.(*ConsulServiceCheckPayload)
+	if !ok {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to deresiger Consul Service Check - missing node address"})
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	nodeAddress := params.NodeAddress
+	if nodeAddress == "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to deresiger Consul Service Check - missing node address"})
+		c.Errorf("Missing node address")
+		return
+	}
+
+	checkID := params.CheckID
+	if checkID == "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to deresiger Consul Service Check - missing check id"})
+		c.Errorf("Missing check id")
+		return
+	}
+
+	client, err := c.agentClient(nodeAddress)
+	if err != nil {
+		logger.Errorf("connection: unable to create consul client : %s", err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to create Consul client : %s", err)})
+		return
+	}
+
+	err = client.Agent().CheckDeregister(checkID)
+	if err != nil {
+		logger.Errorf("connection: unable to deregister consul check '%s': %s", checkID, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to deregister check : %s", err)})
+		return
+	}
+
+	logger.Infof("dereigsterConsulServiceCheck: %s / %s", nodeAddress, checkID)
+	c.reply(action, &Action{Type: successNotification, Payload: "The check has been successfully deregistered."})
+}
+
+func (c *ConsulConnection) watchConsulPreparedQueries(action Action) {
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		queries, meta, err := c.client().PreparedQuery().List(q)
+		if queries == nil {
+			queries = make([]*api.PreparedQueryDefinition, 0)
+		}
+
+		return queries, meta, err
+	}
+
+	c.watchBlockingQuery("consul/prepared-queries", action.Index, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulPreparedQueries, Payload: payload}
+	})
+}
+
+func (c *ConsulConnection) executeConsulPreparedQuery(action Action) {
+	query, ok := action.Payload.(string)
+	if !ok || query == "" {
+		c.Errorf("Could not decode payload")
+		c.sendAction(&Action{Type: errorNotification, Payload: "Unable to execute prepared query - missing query ID or name"})
+		return
+	}
+
+	result, _, err := c.requestClient().PreparedQuery().Execute(query, c.queryOptions(0, 0))
+	if err != nil {
+		logger.Errorf("connection: unable to execute consul prepared query %s: %s", query, err)
+		c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to execute prepared query %s: %s", query, err)})
+		return
+	}
+
+	c.sendAction(&Action{Type: fetchedConsulPreparedQueryResult, Payload: result})
+}
+
+func (c *ConsulConnection) watchConsulSessions(action Action) {
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		sessions, meta, err := c.client().Session().List(q)
+		if sessions == nil {
+			sessions = make([]*api.SessionEntry, 0)
+		}
+
+		return sessions, meta, err
+	}
+
+	c.watchBlockingQuery("consul/sessions", action.Index, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulSessions, Payload: payload}
+	})
+}
+
+func (c *ConsulConnection) destroyConsulSession(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to destroy Consul session: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to destroy Consul session - the Consul backend is set to read-only"})
+		return
+	}
+
+	sessionID, ok := action.Payload.(string)
+	if !ok || sessionID == "" {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	if _, err := c.client().Session().Destroy(sessionID, c.writeOptions()); err != nil {
+		logger.Errorf("connection: unable to destroy consul session %s: %s", sessionID, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to destroy session %s: %s", sessionID, err)})
+		return
+	}
+
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The session was successfully destroyed: %s", sessionID)})
+}
+
+// watchConsulACLTokens streams the (redacted) legacy ACL tokens. Listing them takes a management
+// token, so the connection token set by SET_CONSUL_TOKEN is used.
+func (c *ConsulConnection) watchConsulACLTokens(action Action) {
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		entries, meta, err := c.client().ACL().List(q)
+		if err != nil {
+			return nil, meta, err
+		}
+
+		tokens := make([]*ConsulACLToken, 0, len(entries))
+		for _, entry := range entries {
+			tokens = append(tokens, newConsulACLToken(entry))
+		}
+
+		return tokens, meta, nil
+	}
+
+	c.watchBlockingQuery("consul/acl/tokens", action.Index, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulACLTokens, Payload: payload}
+	})
+}
+
+// findConsulACLToken resolves the handle of a token to its ACL entry
+func (c *ConsulConnection) findConsulACLToken(handle string) (*api.ACLEntry, error) {
+	entries, _, err := c.requestClient().ACL().List(c.queryOptions(0, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if consulACLHandle(entry.ID) == handle {
+			return entry, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no ACL token with handle %s", handle)
+}
+
+func (c *ConsulConnection) createConsulACLToken(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to create Consul ACL token: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to create Consul ACL token - the Consul backend is set to read-only"})
+		return
+	}
+
+	params, ok := action.Payload.(*ConsulACLTokenPayload)
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	switch params.Type {
+	case "":
+		params.Type = api.ACLClientType
+	case api.ACLClientType, api.ACLManagementType:
+	default:
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to create Consul ACL token - invalid type %s", params.Type)})
+		return
+	}
+
+	entry := &api.ACLEntry{Name: params.Name, Type: params.Type, Rules: params.Rules}
+	if _, _, err := c.client().ACL().Create(entry, c.writeOptions()); err != nil {
+		logger.Errorf("connection: unable to create consul acl token %s: %s", params.Name, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to create ACL token %s: %s", params.Name, err)})
+		return
+	}
+
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The ACL token was successfully created: %s", params.Name)})
+}
+
+func (c *ConsulConnection) deleteConsulACLToken(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to delete Consul ACL token: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to delete Consul ACL token - the Consul backend is set to read-only"})
+		return
+	}
+
+	handle, ok := action.Payload.(string)
+	if !ok || handle == "" {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	entry, err := c.findConsulACLToken(handle)
+	if err == nil {
+		_, err = c.client().ACL().Destroy(entry.ID, c.writeOptions())
+	}
 
-	q := &api.QueryOptions{WaitIndex: 1}
-	for {
-		select {
-		case <-c.destroyCh:
-			return
+	if err != nil {
+		logger.Errorf("connection: unable to delete consul acl token %s: %s", handle, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to delete ACL token %s: %s", handle, err)})
+		return
+	}
 
-		default:
-			service, meta, err := c.region.Client.Health().Service(serviceID, "", false, q)
-			if err != nil {
-				c.Errorf("connection: unable to fetch consul service info: %s", err)
-				time.Sleep(10 * time.Second)
-				continue
-			}
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The ACL token was successfully deleted: %s", entry.Name)})
+}
 
-			if !c.watches.Has(serviceID) {
-				return
-			}
+// readConsulACLToken reveals the secret ID of a single token
+func (c *ConsulConnection) readConsulACLToken(action Action) {
+	handle, ok := action.Payload.(string)
+	if !ok || handle == "" {
+		c.Errorf("Could not decode payload")
+		return
+	}
 
-			remoteWaitIndex := meta.LastIndex
-			localWaitIndex := q.WaitIndex
+	entry, err := c.findConsulACLToken(handle)
+	if err != nil {
+		logger.Errorf("connection: unable to read consul acl token %s: %s", handle, err)
+		c.sendAction(&Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to read ACL token %s: %s", handle, err)})
+		return
+	}
 
-			// only broadcast if the LastIndex has changed
-			if remoteWaitIndex > localWaitIndex {
-				c.send <- &Action{Type: fetchedConsulService, Payload: service, Index: remoteWaitIndex}
-				q = &api.QueryOptions{WaitIndex: remoteWaitIndex, WaitTime: 120 * time.Second}
+	c.Infof("Revealing ACL token %s (%s)", handle, entry.Name)
+	c.sendAction(&Action{Type: fetchedConsulACLToken, Payload: entry})
+}
 
-				// don't refresh data more frequent than every 5s, since busy clusters update every second or faster
-				time.Sleep(5 * time.Second)
-			}
-		}
+func consulMembersKey(wan bool) string {
+	if wan {
+		return "consul/members?wan"
 	}
+
+	return "consul/members"
 }
 
-func (c *ConsulConnection) watchConsulNode(action Action) {
-	nodeID := action.Payload.(string)
-	key := "consul/node/" + nodeID
+func (c *ConsulConnection) watchConsulMembers(action Action) {
+	wan, _ := action.Payload.(bool)
+	key := consulMembersKey(wan)
 
 	if c.watches.Has(key) {
 		c.Warningf("Connection is already subscribed to %s", key)
+		c.sendWatchEvent(consulWatchStarted, key, true)
 		return
 	}
 
-	defer func() {
-		c.watches.Remove(key)
-		c.Infof("Stopped watching %s", key)
-	}()
-	c.watches.Add(key)
+	ctx := c.watchContext()
+	defer c.stopWatch(ctx, key)
+	c.addWatch(ctx, key)
+	c.sendWatchEvent(consulWatchStarted, key, false)
 
 	c.Infof("Started watching %s", key)
 
-	raw := c.region.Client.Raw()
-	q := &api.QueryOptions{WaitIndex: 0}
+	endpoint := "/v1/agent/members"
+	if wan {
+		endpoint += "?wan=1"
+	}
 
+	retry := newBackoff(watchRetryMin, watchRetryMax)
+	var lastChecksum uint64
 	for {
-		var node ConsulInternalNode
-
-		meta, err := raw.Query(fmt.Sprintf("/v1/internal/ui/node/%s", nodeID), &node, q)
+		// Agent().Members takes no options, and would use the token of hashi-ui instead of the
+		// connection one
+		var agentMembers []*api.AgentMember
+		err := c.region.rawRequest(ctx, "GET", endpoint, "", "", c.aclToken(), nil, &agentMembers)
 		if err != nil {
-			logger.Errorf("watch: unable to fetch node/%s: %s", nodeID, err)
-			time.Sleep(10 * time.Second)
-			continue
-		}
-
-		remoteWaitIndex := meta.LastIndex
-		localWaitIndex := q.WaitIndex
+			if !c.watching(ctx, key) {
+				return
+			}
 
-		// only work if the WaitIndex have changed
-		if remoteWaitIndex == localWaitIndex {
-			logger.Debugf("Node/%s index is unchanged (%d == %d)", nodeID, localWaitIndex, remoteWaitIndex)
+			c.Errorf("connection: unable to fetch consul members: %s", err)
+			c.retryWatch(ctx, key, err, retry)
 			continue
 		}
+		retry.Reset()
+		c.recordWatchSuccess(key, 0)
+
+		members := make([]*ConsulAgentMember, 0, len(agentMembers))
+		for _, member := range agentMembers {
+			members = append(members, &ConsulAgentMember{
+				Name:   member.Name,
+				Addr:   member.Addr,
+				Port:   member.Port,
+				Tags:   member.Tags,
+				Status: consulMemberStatus[member.Status],
+			})
+		}
 
-		logger.Debugf("Node/%s index is changed (%d <> %d)", nodeID, localWaitIndex, remoteWaitIndex)
+		if c.watching(ctx, key) && c.payloadChanged(members, &lastChecksum) {
+			c.sendWatchAction(key, &Action{Type: fetchedConsulMembers, Payload: members})
+		}
 
-		if !c.watches.Has(key) {
-			c.Warningf("Connection is not subscribed to %s", key)
+		if !c.watching(ctx, key) {
 			return
 		}
 
-		c.send <- &Action{Type: fetchedConsulNode, Payload: node, Index: remoteWaitIndex}
-		q = &api.QueryOptions{WaitIndex: remoteWaitIndex}
+		// the members endpoint has no index to block on, so poll it
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-time.After(c.MembersPollInterval):
+		}
 	}
 }
 
-func (c *ConsulConnection) watchConsulKVPath(action Action) {
-	path := action.Payload.(string)
-	key := "consul/kv/path?" + path
+// consulCatalogServiceWatch decodes the payload of a (un)watch catalog service action, either
+// the service name or an object with a name and optional tag
+func consulCatalogServiceWatch(payload interface{}) (name, tag, key string) {
+	switch params := payload.(type) {
+	case string:
+		name = params
+	case map[string]interface{}:
+		name, _ = params["name"].(string)
+		tag, _ = params["tag"].(string)
+	}
 
-	if c.watches.Has(key) {
-		c.Warningf("Connection is already subscribed to %s", key)
+	return name, tag, fmt.Sprintf("consul/catalog/service/%s?tag=%s", name, tag)
+}
+
+func (c *ConsulConnection) watchConsulCatalogService(action Action) {
+	name, tag, key := consulCatalogServiceWatch(action.Payload)
+	if name == "" {
+		c.Errorf("Could not decode payload")
 		return
 	}
 
-	defer func() {
-		c.watches.Remove(key)
-		c.Infof("Stopped watching %s", key)
-	}()
-	c.watches.Add(key)
+	query := func(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+		instances, meta, err := c.client().Catalog().Service(name, tag, q)
+		if instances == nil {
+			instances = make([]*api.CatalogService, 0)
+		}
 
-	c.Infof("Started watching %s", key)
+		return instances, meta, err
+	}
 
-	q := &api.QueryOptions{WaitIndex: 1}
-	for {
-		select {
-		case <-c.destroyCh:
-			return
+	c.watchBlockingQuery(key, action.Index, query, func(payload interface{}) *Action {
+		return &Action{Type: fetchedConsulCatalogService, Payload: payload}
+	})
+}
 
-		default:
-			keys, meta, err := c.region.Client.KV().Keys(path, "/", q)
-			if err != nil {
-				c.Errorf("connection: unable to fetch consul node info: %s", err)
-				time.Sleep(10 * time.Second)
-				continue
-			}
+// agentClient creates a client for the Consul agent running on the node at nodeAddress. Agents
+// are assumed to listen on the port (and TLS setup) of the one hashi-ui is configured with.
+func (c *ConsulConnection) agentClient(nodeAddress string) (*api.Client, error) {
+	config, err := consulAPIConfig(c.region.Config, nodeAddress)
+	if err != nil {
+		return nil, err
+	}
 
-			if !c.watches.Has(key) {
-				return
-			}
+	_, port, _ := net.SplitHostPort(c.region.Config.ConsulAddress)
+	if port == "" {
+		port = "8500"
+		if config.Scheme == "https" {
+			port = "8501"
+		}
+	}
 
-			remoteWaitIndex := meta.LastIndex
-			localWaitIndex := q.WaitIndex
+	config.Address = net.JoinHostPort(nodeAddress, port)
+	config.Token = c.aclToken()
 
-			// only broadcast if the LastIndex has changed
-			if remoteWaitIndex == localWaitIndex {
-				time.Sleep(5 * time.Second)
-				continue
-			}
+	// agents are only sent one-shot requests, and an unreachable node mustn't hang them
+	setRequestTimeout(config, c.region.Config.ConsulRequestTimeout)
 
-			c.send <- &Action{Type: fetchedConsulKVPath, Payload: keys, Index: remoteWaitIndex}
-			q = &api.QueryOptions{WaitIndex: remoteWaitIndex, WaitTime: 120 * time.Second}
-		}
+	return api.NewClient(config)
+}
+
+// nodeAgentClient creates a client for the Consul agent running on a node, and makes sure that
+// agent really is the one for nodeName, since maintenance mode can only be set by the local agent
+func (c *ConsulConnection) nodeAgentClient(nodeName, nodeAddress string) (*api.Client, error) {
+	client, err := c.agentClient(nodeAddress)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Consul client: %s", err)
+	}
+
+	agentNodeName, err := client.Agent().NodeName()
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach the agent on %s: %s", nodeAddress, err)
+	}
+
+	if agentNodeName != nodeName {
+		return nil, fmt.Errorf("the agent on %s is %s, not the local agent of %s", nodeAddress, agentNodeName, nodeName)
 	}
+
+	return client, nil
 }
 
-func (c *ConsulConnection) writeConsulKV(action Action) {
+func (c *ConsulConnection) toggleConsulNodeMaintenance(action Action) {
 	if c.region.Config.ConsulReadOnly {
-		logger.Warningf("Unable to write Consul KV: ConsulReadOnly is set to true")
-		c.send <- &Action{Type: errorNotification, Payload: "Unable to write Consul KV - the Consul backend is set to read-only"}
+		logger.Warningf("Unable to toggle Consul node maintenance: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to toggle node maintenance - the Consul backend is set to read-only"})
 		return
 	}
 
-	params, ok := action.Payload.(map[string]interface{})
+	params, ok := action.Payload.(*ConsulMaintenancePayload)
 	if !ok {
 		c.Errorf("Could not decode payload")
 		return
 	}
 
-	key := params["path"].(string)
-	value := params["value"].(string)
-	index := uint64(0)
-
-	if val, ok := params["index"]; ok {
-		index = uint64(val.(float64))
-	}
-
-	keyPair := &api.KVPair{Key: key, Value: []byte(value), ModifyIndex: index}
+	state := &ConsulMaintenanceState{Node: params.NodeName, Enabled: params.Enable, Reason: params.Reason}
+	nodeAddress := params.NodeAddress
 
-	res, _, err := c.region.Client.KV().CAS(keyPair, &api.WriteOptions{})
+	client, err := c.nodeAgentClient(state.Node, nodeAddress)
 	if err != nil {
-		logger.Errorf("connection: unable to write consul kv '%s': %s", key, err)
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to write key %s: %s", key, err)}
+		logger.Errorf("connection: unable to toggle maintenance of consul node %s: %s", state.Node, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to toggle maintenance of node %s: %s", state.Node, err)})
 		return
 	}
 
-	if !res {
-		logger.Errorf("connection: unable to write consul kv '%s': %s", key, err)
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to write key %s: maybe the key was modified since you loaded it?", key)}
-		return
+	if state.Enabled {
+		err = client.Agent().EnableNodeMaintenance(state.Reason)
+	} else {
+		err = client.Agent().DisableNodeMaintenance()
 	}
 
-	c.send <- &Action{Type: successNotification, Payload: fmt.Sprintf("The key was successfully written: %s.", key)}
-
-	if key[len(key)-1:] != "/" {
-		// refresh data post-save
-		c.getConsulKVPair(Action{Payload: key})
+	if err != nil {
+		logger.Errorf("connection: unable to toggle maintenance of consul node %s: %s", state.Node, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to toggle maintenance of node %s: %s", state.Node, err)})
+		return
 	}
+
+	c.reply(action, &Action{Type: toggledConsulNodeMaintenance, Payload: state})
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("Maintenance mode of node %s is now %s", state.Node, onOff(state.Enabled))})
 }
 
-func (c *ConsulConnection) deleteConsulKV(action Action) {
+func (c *ConsulConnection) toggleConsulServiceMaintenance(action Action) {
 	if c.region.Config.ConsulReadOnly {
-		logger.Warningf("Unable to delete Consul KV: ConsulReadOnly is set to true")
-		c.send <- &Action{Type: errorNotification, Payload: "Unable to delete Consul KV - the Consul backend is set to read-only"}
+		logger.Warningf("Unable to toggle Consul service maintenance: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to toggle service maintenance - the Consul backend is set to read-only"})
 		return
 	}
 
-	key := action.Payload.(string)
-
-	_, err := c.region.Client.KV().DeleteTree(key, &api.WriteOptions{})
-	if err != nil {
-		logger.Errorf("connection: unable to delete consul kv '%s': %s", key, err)
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to write key : %s", key)}
+	params, ok := action.Payload.(*ConsulMaintenancePayload)
+	if !ok {
+		c.Errorf("Could not decode payload")
 		return
 	}
 
-	c.send <- &Action{Type: successNotification, Payload: fmt.Sprintf("The key was successfully deleted: %s.", key)}
-}
+	state := &ConsulMaintenanceState{Node: params.NodeName, ServiceID: params.ServiceID, Enabled: params.Enable, Reason: params.Reason}
+	nodeAddress := params.NodeAddress
 
-func (c *ConsulConnection) getConsulKVPair(action Action) {
-	key := action.Payload.(string)
+	if state.ServiceID == "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to toggle service maintenance - missing service ID"})
+		return
+	}
 
-	pair, _, err := c.region.Client.KV().Get(key, &api.QueryOptions{})
+	client, err := c.nodeAgentClient(state.Node, nodeAddress)
 	if err != nil {
-		logger.Errorf("connection: unable to get consul kv '%s': %s", key, err)
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to read key : %s", key)}
+		logger.Errorf("connection: unable to toggle maintenance of consul service %s: %s", state.ServiceID, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to toggle maintenance of service %s: %s", state.ServiceID, err)})
 		return
 	}
 
-	if pair == nil {
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to read key : %s", key)}
+	if state.Enabled {
+		err = client.Agent().EnableServiceMaintenance(state.ServiceID, state.Reason)
+	} else {
+		err = client.Agent().DisableServiceMaintenance(state.ServiceID)
+	}
+
+	if err != nil {
+		logger.Errorf("connection: unable to toggle maintenance of consul service %s: %s", state.ServiceID, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to toggle maintenance of service %s: %s", state.ServiceID, err)})
 		return
 	}
 
-	c.send <- &Action{Type: fetchedConsulKVPair, Payload: pair, Index: pair.ModifyIndex}
+	c.reply(action, &Action{Type: toggledConsulServiceMaintenance, Payload: state})
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("Maintenance mode of service %s is now %s", state.ServiceID, onOff(state.Enabled))})
 }
 
-func (c *ConsulConnection) deleteConsulKvPair(action Action) {
-	if c.region.Config.ConsulReadOnly {
-		logger.Warningf("Unable to delete Consul KV: ConsulReadOnly is set to true")
-		c.send <- &Action{Type: errorNotification, Payload: "Unable to delete Consul KV - the Consul backend is set to read-only"}
-		return
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
 	}
 
-	params, ok := action.Payload.(map[string]interface{})
+	return "off"
+}
+
+func (c *ConsulConnection) fetchConsulNodeRTT(action Action) {
+	params, ok := action.Payload.(*ConsulNodeRTTPayload)
 	if !ok {
 		c.Errorf("Could not decode payload")
 		return
 	}
 
-	key := params["path"].(string)
-	index := uint64(0)
-
-	if val, ok := params["index"]; ok {
-		index = uint64(val.(float64))
-	}
-
-	keyPair := &api.KVPair{Key: key, ModifyIndex: index}
+	result := &ConsulNodeRTT{Source: params.Source, Destination: params.Destination}
 
-	success, _, err := c.region.Client.KV().DeleteCAS(keyPair, &api.WriteOptions{})
+	entries, _, err := c.requestClient().Coordinate().Nodes(c.queryOptions(0, 0))
 	if err != nil {
-		logger.Errorf("connection: unable to get consul kv '%s': %s", key, err)
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to delete key %s: %s", key, err)}
+		c.Errorf("connection: unable to fetch consul coordinates: %s", err)
+		result.Error = err.Error()
+		c.sendAction(&Action{Type: fetchedConsulNodeRTT, Payload: result})
 		return
 	}
 
-	if !success {
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to delete key %s", key)}
-		return
+	var source, destination *api.CoordinateEntry
+	for _, entry := range entries {
+		switch entry.Node {
+		case result.Source:
+			source = entry
+		case result.Destination:
+			destination = entry
+		}
+	}
+
+	switch {
+	case source == nil || source.Coord == nil:
+		result.Error = fmt.Sprintf("no coordinate for node %s", result.Source)
+	case destination == nil || destination.Coord == nil:
+		result.Error = fmt.Sprintf("no coordinate for node %s", result.Destination)
+	default:
+		result.RTT = source.Coord.DistanceTo(destination.Coord).Seconds() * 1000
 	}
 
-	c.send <- &Action{Type: successNotification, Payload: fmt.Sprintf("Successfully deleted %s", key)}
-	c.send <- &Action{Type: clearConsulKvPair}
+	c.sendAction(&Action{Type: fetchedConsulNodeRTT, Payload: result})
 }
 
-func (c *ConsulConnection) dereigsterConsulService(action Action) {
-	if c.region.Config.ConsulReadOnly {
-		logger.Warningf("Unable to deregister Consul Service: ConsulReadOnly is set to true")
-		c.send <- &Action{Type: errorNotification, Payload: "Unable to deresiger Consul Service - the Consul backend is set to read-only"}
-		return
-	}
+func (c *ConsulConnection) watchConsulCoordinates() {
+	key := "consul/coordinates"
 
-	params, ok := action.Payload.(map[string]interface{})
-	if !ok {
-		c.Errorf("Could not decode payload")
+	if c.watches.Has(key) {
+		c.Warningf("Connection is already subscribed to %s", key)
+		c.sendWatchEvent(consulWatchStarted, key, true)
 		return
 	}
 
-	nodeAddress := params["nodeAddress"].(string)
-	serviceID := params["serviceID"].(string)
+	ctx := c.watchContext()
+	defer c.stopWatch(ctx, key)
+	c.addWatch(ctx, key)
+	c.sendWatchEvent(consulWatchStarted, key, false)
 
-	_, port, _ := net.SplitHostPort(c.region.Config.ConsulAddress)
-	if port == "" {
-		port = "80"
-	}
+	c.Infof("Started watching %s", key)
 
-	config := api.DefaultConfig()
-	config.Address = nodeAddress + ":" + port
+	retry := newBackoff(watchRetryMin, watchRetryMax)
+	var lastChecksum uint64
+	for {
+		entries, meta, err := c.client().Coordinate().Nodes(c.queryOptions(0, 0))
+		if err != nil {
+			if !c.watching(ctx, key) {
+				return
+			}
 
-	client, err := api.NewClient(config)
-	if err != nil {
-		logger.Errorf("connection: unable to create consul client : %s", err)
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to create Consul client : %s", err)}
-		return
+			c.Errorf("connection: unable to fetch consul coordinates: %s", err)
+			c.retryWatch(ctx, key, err, retry)
+			continue
+		}
+		retry.Reset()
+
+		if c.watching(ctx, key) && c.payloadChanged(entries, &lastChecksum) {
+			if entries == nil {
+				entries = make([]*api.CoordinateEntry, 0)
+			}
+
+			c.recordWatchSuccess(key, meta.LastIndex)
+			c.sendWatchAction(key, &Action{Type: fetchedConsulCoordinates, Payload: entries, Index: meta.LastIndex})
+		}
+
+		if !c.watching(ctx, key) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-time.After(c.CoordinatesPollInterval):
+		}
 	}
+}
 
-	err = client.Agent().ServiceDeregister(serviceID)
-	if err != nil {
-		logger.Errorf("connection: unable to deregister consul service '%s': %s", serviceID, err)
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to deregister service : %s", err)}
+// watchConsulRaftConfiguration polls the raft configuration of the Consul servers, and sends it
+// whenever the peers, their voter status or the leader change
+func (c *ConsulConnection) watchConsulRaftConfiguration() {
+	key := "consul/raft/configuration"
+
+	if c.watches.Has(key) {
+		c.Warningf("Connection is already subscribed to %s", key)
+		c.sendWatchEvent(consulWatchStarted, key, true)
 		return
 	}
 
-	c.send <- &Action{Type: successNotification, Payload: "The service has been successfully deregistered."}
+	ctx := c.watchContext()
+	defer c.stopWatch(ctx, key)
+	c.addWatch(ctx, key)
+	c.sendWatchEvent(consulWatchStarted, key, false)
+
+	c.Infof("Started watching %s", key)
+
+	retry := newBackoff(watchRetryMin, watchRetryMax)
+	var lastChecksum uint64
+	for {
+		configuration, err := c.client().Operator().RaftGetConfiguration(c.queryOptions(0, 0))
+		if err != nil {
+			if !c.watching(ctx, key) {
+				return
+			}
+
+			c.Errorf("connection: unable to fetch consul raft configuration: %s", err)
+			c.retryWatch(ctx, key, err, retry)
+			continue
+		}
+		retry.Reset()
+
+		if result := newConsulRaftConfiguration(configuration); c.watching(ctx, key) && c.payloadChanged(result, &lastChecksum) {
+			c.recordWatchSuccess(key, result.Index)
+			c.sendWatchAction(key, &Action{Type: fetchedConsulRaftConfiguration, Payload: result, Index: result.Index})
+		}
+
+		if !c.watching(ctx, key) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-time.After(c.RaftPollInterval):
+		}
+	}
 }
 
-func (c *ConsulConnection) dereigsterConsulServiceCheck(action Action) {
-	if c.region.Config.ConsulReadOnly {
-		logger.Warningf("Unable to deregister Consul Service Check: ConsulReadOnly is set to true")
-		c.send <- &Action{Type: errorNotification, Payload: "Unable to deresiger Consul Service Check - the Consul backend is set to read-only"}
+// watchConsulEvents streams the user events known to the agent. Only events that were not sent
+// before are included in each fetchedConsulEvents action, so the first one carries the whole
+// list and the following ones just the new events.
+func (c *ConsulConnection) watchConsulEvents() {
+	key := "consul/events"
+
+	if c.watches.Has(key) {
+		c.Warningf("Connection is already subscribed to %s", key)
+		c.sendWatchEvent(consulWatchStarted, key, true)
 		return
 	}
 
-	params, ok := action.Payload.(map[string]interface{})
-	if !ok {
-		c.send <- &Action{Type: errorNotification, Payload: "Unable to deresiger Consul Service Check - missing node address"}
-		c.Errorf("Could not decode payload")
-		return
+	ctx := c.watchContext()
+	defer c.stopWatch(ctx, key)
+	c.addWatch(ctx, key)
+	c.sendWatchEvent(consulWatchStarted, key, false)
+
+	c.Infof("Started watching %s", key)
+
+	q := c.queryOptions(0, 0)
+	retry := newBackoff(watchRetryMin, watchRetryMax)
+	var lastLTime uint64
+	var seeded bool
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		default:
+			started := time.Now()
+			events, meta, err := c.client().Event().List("", q)
+			if err != nil {
+				c.Errorf("connection: unable to fetch consul events: %s", err)
+				c.retryWatch(ctx, key, err, retry)
+				continue
+			}
+			retry.Reset()
+
+			if !c.watching(ctx, key) {
+				return
+			}
+
+			// the event index is a hash of the latest event ID rather than a raft index,
+			// so it can only be compared for equality
+			remoteWaitIndex := meta.LastIndex
+			c.recordWatchSuccess(key, remoteWaitIndex)
+			if remoteWaitIndex == q.WaitIndex {
+				if !c.waitIfIdle(ctx, started) {
+					return
+				}
+				continue
+			}
+
+			q = c.queryOptions(remoteWaitIndex, c.region.Config.ConsulWaitTime)
+
+			newEvents := make([]*api.UserEvent, 0)
+			latestLTime := lastLTime
+			for _, event := range events {
+				if event.LTime > lastLTime {
+					newEvents = append(newEvents, event)
+				}
+
+				if event.LTime > latestLTime {
+					latestLTime = event.LTime
+				}
+			}
+			lastLTime = latestLTime
+
+			// always send the first list, even if empty, but after that only new events
+			if len(newEvents) == 0 && seeded {
+				continue
+			}
+			seeded = true
+
+			c.sendWatchAction(key, &Action{Type: fetchedConsulEvents, Payload: newEvents, Index: remoteWaitIndex, Meta: c.actionMeta(meta)})
+		}
 	}
+}
 
-	nodeAddress, ok := params["nodeAddress"].(string)
-	if !ok {
-		c.send <- &Action{Type: errorNotification, Payload: "Unable to deresiger Consul Service Check - missing node address"}
-		c.Errorf("Missing node address")
+func (c *ConsulConnection) fireConsulEvent(action Action) {
+	if c.region.Config.ConsulReadOnly {
+		logger.Warningf("Unable to fire Consul event: ConsulReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to fire Consul event - the Consul backend is set to read-only"})
 		return
 	}
 
-	checkID, ok := params["checkID"].(string)
+	params, ok := action.Payload.(*ConsulEventPayload)
 	if !ok {
-		c.send <- &Action{Type: errorNotification, Payload: "Unable to deresiger Consul Service Check - missing check id"}
-		c.Errorf("Missing check id")
+		c.Errorf("Could not decode payload")
 		return
 	}
 
-	_, port, _ := net.SplitHostPort(c.region.Config.ConsulAddress)
-	if port == "" {
-		port = "80"
-	}
-
-	config := api.DefaultConfig()
-	config.Address = nodeAddress + ":" + port
+	name := params.Name
+	payload := params.Payload
 
-	client, err := api.NewClient(config)
-	if err != nil {
-		logger.Errorf("connection: unable to create consul client : %s", err)
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to create Consul client : %s", err)}
+	if name == "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to fire Consul event - missing event name"})
 		return
 	}
 
-	err = client.Agent().CheckDeregister(checkID)
+	id, _, err := c.client().Event().Fire(&api.UserEvent{Name: name, Payload: []byte(payload)}, c.writeOptions())
 	if err != nil {
-		logger.Errorf("connection: unable to deregister consul check '%s': %s", checkID, err)
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to deregister check : %s", err)}
+		logger.Errorf("connection: unable to fire consul event %s: %s", name, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to fire event %s: %s", name, err)})
 		return
 	}
 
-	logger.Infof("dereigsterConsulServiceCheck: %s / %s", nodeAddress, checkID)
-	c.send <- &Action{Type: successNotification, Payload: "The check has been successfully deregistered."}
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("The event %s was successfully fired: %s", name, id)})
 }
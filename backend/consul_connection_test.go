@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	api "github.com/hashicorp/consul/api"
+)
+
+// newTestConsulConnection creates a connection without a socket, to a region with the default
+// config. Its actions stay queued in c.send for the test to read.
+func newTestConsulConnection() *ConsulConnection {
+	hub := &ConsulHub{
+		connections: make(map[*ConsulConnection]bool),
+		register:    make(chan *ConsulConnection, 1),
+		unregister:  make(chan *ConsulConnection, 1),
+	}
+
+	region := &ConsulRegion{Config: DefaultConfig(), Datacenter: "dc1"}
+
+	c := NewConsulConnection(hub, nil, region, nil, 100)
+	c.MinUpdateInterval = 0
+
+	return c
+}
+
+// fakeQueryResult is what a fakeBlockingQuery answers to one query
+type fakeQueryResult struct {
+	payload interface{}
+	index   uint64
+	err     error
+
+	// blockFor makes the query take that long, as a blocking query timing out does
+	blockFor time.Duration
+}
+
+// fakeBlockingQuery answers the queries of a watch with results, in order. Once they are all
+// used up, it closes exhausted and blocks the next query until the watch is stopped.
+type fakeBlockingQuery struct {
+	results     []fakeQueryResult
+	waitIndexes []uint64
+	exhausted   chan struct{}
+	release     chan struct{}
+}
+
+func newFakeBlockingQuery(results ...fakeQueryResult) *fakeBlockingQuery {
+	return &fakeBlockingQuery{results: results, exhausted: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (f *fakeBlockingQuery) query(q *api.QueryOptions) (interface{}, *api.QueryMeta, error) {
+	f.waitIndexes = append(f.waitIndexes, q.WaitIndex)
+
+	if len(f.results) == 0 {
+		close(f.exhausted)
+		<-f.release
+		return nil, &api.QueryMeta{LastIndex: q.WaitIndex}, nil
+	}
+
+	result := f.results[0]
+	f.results = f.results[1:]
+
+	time.Sleep(result.blockFor)
+
+	return result.payload, &api.QueryMeta{LastIndex: result.index}, result.err
+}
+
+// runFakeWatch runs watchBlockingQuery on f until its results are used up, and returns the
+// actions sent in the meantime
+func runFakeWatch(t *testing.T, c *ConsulConnection, f *fakeBlockingQuery) []*Action {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.watchBlockingQuery("test", 0, f.query, func(payload interface{}) *Action {
+			return &Action{Type: fetchedConsulService, Payload: payload}
+		})
+	}()
+
+	select {
+	case <-f.exhausted:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("watch stopped querying after %d queries", len(f.waitIndexes))
+	}
+
+	c.unwatchAll()
+	close(f.release)
+	<-done
+
+	actions := make([]*Action, 0, len(c.send))
+	for len(c.send) > 0 {
+		actions = append(actions, <-c.send)
+	}
+
+	return actions
+}
+
+// sentUpdates returns the actions of type actionType among actions
+func sentUpdates(actions []*Action, actionType string) []*Action {
+	updates := make([]*Action, 0, len(actions))
+	for _, action := range actions {
+		if action.Type == actionType {
+			updates = append(updates, action)
+		}
+	}
+
+	return updates
+}
+
+func TestPayloadChanged(t *testing.T) {
+	c := newTestConsulConnection()
+
+	cases := []struct {
+		name    string
+		payload interface{}
+		changed bool
+	}{
+		{"first payload", []string{"web", "db"}, true},
+		{"same payload", []string{"web", "db"}, false},
+		{"reordered payload", []string{"db", "web"}, true},
+		{"new payload", map[string]int{"web": 2}, true},
+		{"same map", map[string]int{"web": 2}, false},
+	}
+
+	var last uint64
+	for _, tc := range cases {
+		if changed := c.payloadChanged(tc.payload, &last); changed != tc.changed {
+			t.Errorf("%s: payloadChanged returned %t, expected %t", tc.name, changed, tc.changed)
+		}
+	}
+}
+
+func TestWatchBlockingQuerySkipsIdenticalPayloads(t *testing.T) {
+	c := newTestConsulConnection()
+	f := newFakeBlockingQuery(
+		fakeQueryResult{payload: []string{"web"}, index: 10},
+		fakeQueryResult{payload: []string{"web"}, index: 11},
+		fakeQueryResult{payload: []string{"web"}, index: 12},
+		fakeQueryResult{payload: []string{"web", "db"}, index: 13},
+	)
+
+	updates := sentUpdates(runFakeWatch(t, c, f), fetchedConsulService)
+
+	if len(updates) != 2 {
+		t.Fatalf("sent %d updates, expected 2", len(updates))
+	}
+
+	if updates[0].Index != 10 || updates[1].Index != 13 {
+		t.Errorf("sent updates at indexes %d and %d, expected 10 and 13", updates[0].Index, updates[1].Index)
+	}
+}
+
+func TestStartWatchLimit(t *testing.T) {
+	for _, limit := range []int{1, 3, 10} {
+		c := newTestConsulConnection()
+		c.region.Config.ConsulMaxWatches = limit
+
+		release := make(chan struct{})
+		started := make(chan int, limit+1)
+		for i := 0; i <= limit; i++ {
+			i := i
+			c.startWatch(func() {
+				started <- i
+				<-release
+			})
+		}
+
+		for i := 0; i < limit; i++ {
+			<-started
+		}
+
+		// the refusal is sent by startWatch itself, before it returns
+		select {
+		case action := <-c.send:
+			if action.Type != errorNotification {
+				t.Errorf("limit %d: watch %d was answered with %s, expected %s", limit, limit+1, action.Type, errorNotification)
+			}
+		default:
+			t.Errorf("limit %d: watch %d wasn't refused", limit, limit+1)
+		}
+
+		close(release)
+		c.hub.routines.Wait()
+
+		select {
+		case i := <-started:
+			t.Errorf("limit %d: watch %d was started past the limit", limit, i+1)
+		default:
+		}
+
+		// the stopped watches make room for new ones
+		done := make(chan struct{})
+		c.startWatch(func() { close(done) })
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Errorf("limit %d: watch refused after the running ones stopped", limit)
+		}
+		c.hub.routines.Wait()
+	}
+}
+
+func TestReadPumpReadLimit(t *testing.T) {
+	const limit = 1024
+
+	cases := []struct {
+		name       string
+		size       int
+		disconnect bool
+	}{
+		{"small message", 10, false},
+		{"message at the limit", limit, false},
+		{"message over the limit", limit + 1, true},
+		{"huge message", 100 * limit, true},
+	}
+
+	for _, tc := range cases {
+		c := newTestConsulConnection()
+		c.region.Config.WebsocketReadLimit = limit
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			socket, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				t.Errorf("%s: unable to upgrade: %s", tc.name, err)
+				return
+			}
+
+			c.socket = socket
+			c.readPump()
+		}))
+
+		client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("%s: unable to connect: %s", tc.name, err)
+		}
+		<-c.hub.register
+
+		// the message isn't JSON, a connection reading it answers with an error notification
+		if err := client.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", tc.size))); err != nil {
+			t.Fatalf("%s: unable to send the message: %s", tc.name, err)
+		}
+
+		select {
+		case <-c.hub.unregister:
+			if !tc.disconnect {
+				t.Errorf("%s: connection closed", tc.name)
+			}
+
+			if _, _, err := client.ReadMessage(); err == nil {
+				t.Errorf("%s: socket still open after the connection closed", tc.name)
+			}
+		case action := <-c.send:
+			if tc.disconnect {
+				t.Errorf("%s: message was read instead of closing the connection", tc.name)
+			}
+
+			if action.Type != errorNotification {
+				t.Errorf("%s: message was answered with %s, expected %s", tc.name, action.Type, errorNotification)
+			}
+		case <-time.After(10 * time.Second):
+			t.Errorf("%s: message was neither read nor closed the connection", tc.name)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestWatchBlockingQuery(t *testing.T) {
+	cases := []struct {
+		name        string
+		results     []fakeQueryResult
+		waitIndexes []uint64
+		sentIndexes []uint64
+		errors      int
+	}{
+		{
+			name:        "index advances",
+			results:     []fakeQueryResult{{payload: "a", index: 1}, {payload: "b", index: 2}, {payload: "c", index: 5}},
+			waitIndexes: []uint64{0, 1, 2, 5},
+			sentIndexes: []uint64{1, 2, 5},
+		},
+		{
+			name:        "index unchanged after the wait time",
+			results:     []fakeQueryResult{{payload: "a", index: 5}, {payload: "a", index: 5, blockFor: minBlockingQueryTime}},
+			waitIndexes: []uint64{0, 5, 5},
+			sentIndexes: []uint64{5},
+		},
+		{
+			name:        "index goes backwards after a server restart",
+			results:     []fakeQueryResult{{payload: "a", index: 10}, {payload: "b", index: 5}, {payload: "b", index: 6}},
+			waitIndexes: []uint64{0, 10, 1, 6},
+			sentIndexes: []uint64{10, 6},
+		},
+		{
+			name:        "index goes back to zero",
+			results:     []fakeQueryResult{{payload: "a", index: 42}, {payload: "a", index: 0}, {payload: "b", index: 3}},
+			waitIndexes: []uint64{0, 42, 1, 3},
+			sentIndexes: []uint64{42, 3},
+		},
+		{
+			name:        "query fails then recovers",
+			results:     []fakeQueryResult{{err: errors.New("Unexpected response code: 500")}, {payload: "a", index: 7}},
+			waitIndexes: []uint64{0, 0, 7},
+			sentIndexes: []uint64{7},
+			errors:      1,
+		},
+	}
+
+	for _, tc := range cases {
+		c := newTestConsulConnection()
+		f := newFakeBlockingQuery(tc.results...)
+		actions := runFakeWatch(t, c, f)
+		updates := sentUpdates(actions, fetchedConsulService)
+
+		if len(f.waitIndexes) != len(tc.waitIndexes) {
+			t.Fatalf("%s: queried with wait indexes %v, expected %v", tc.name, f.waitIndexes, tc.waitIndexes)
+		}
+		for i, index := range tc.waitIndexes {
+			if f.waitIndexes[i] != index {
+				t.Errorf("%s: queried with wait indexes %v, expected %v", tc.name, f.waitIndexes, tc.waitIndexes)
+				break
+			}
+		}
+
+		if len(updates) != len(tc.sentIndexes) {
+			t.Fatalf("%s: sent %d updates, expected %d", tc.name, len(updates), len(tc.sentIndexes))
+		}
+		for i, index := range tc.sentIndexes {
+			if updates[i].Index != index {
+				t.Errorf("%s: update %d has index %d, expected %d", tc.name, i, updates[i].Index, index)
+			}
+		}
+
+		if notifications := sentUpdates(actions, errorNotification); len(notifications) != tc.errors {
+			t.Errorf("%s: sent %d error notifications, expected %d", tc.name, len(notifications), tc.errors)
+		}
+
+		if started := sentUpdates(actions, consulWatchStarted); len(started) != 1 {
+			t.Errorf("%s: sent %d %s, expected 1", tc.name, len(started), consulWatchStarted)
+		}
+	}
+}
+
+func TestFilterServiceEntries(t *testing.T) {
+	entry := func(id string, tags []string, statuses ...string) *ConsulServiceEntry {
+		checks := make(api.HealthChecks, 0, len(statuses))
+		for _, status := range statuses {
+			checks = append(checks, &api.HealthCheck{Status: status})
+		}
+
+		return &ConsulServiceEntry{Service: &ConsulAgentService{AgentService: api.AgentService{ID: id, Tags: tags}}, Checks: checks}
+	}
+
+	entries := []*ConsulServiceEntry{
+		entry("web-1", []string{"primary"}, api.HealthPassing, api.HealthPassing),
+		entry("web-2", []string{"primary", "canary"}, api.HealthPassing, api.HealthCritical),
+		entry("web-3", nil, api.HealthPassing),
+		entry("web-4", []string{"canary"}, api.HealthWarning),
+		{Node: &api.Node{Node: "gone"}},
+	}
+
+	cases := []struct {
+		name        string
+		tag         string
+		passingOnly bool
+		ids         []string
+	}{
+		{"no filter", "", false, []string{"web-1", "web-2", "web-3", "web-4"}},
+		{"tag", "canary", false, []string{"web-2", "web-4"}},
+		{"passing only", "", true, []string{"web-1", "web-3"}},
+		{"tag and passing only", "primary", true, []string{"web-1"}},
+		{"unknown tag", "secondary", false, []string{}},
+	}
+
+	for _, tc := range cases {
+		filtered := filterServiceEntries(entries, tc.tag, tc.passingOnly)
+
+		ids := make([]string, 0, len(filtered))
+		for _, entry := range filtered {
+			ids = append(ids, entry.Service.ID)
+		}
+
+		if strings.Join(ids, ",") != strings.Join(tc.ids, ",") {
+			t.Errorf("%s: kept %v, expected %v", tc.name, ids, tc.ids)
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	api "github.com/hashicorp/consul/api"
 )
 
 // ConsulHub keeps track of all the websocket connections and sends state updates
@@ -17,6 +23,11 @@ type ConsulHub struct {
 	regions     []string
 	register    chan *ConsulConnection
 	unregister  chan *ConsulConnection
+	lock        sync.RWMutex
+
+	// routines tracks the connection handlers and their watches, so Shutdown can wait for them
+	routines     sync.WaitGroup
+	shuttingDown bool
 }
 
 // NewConsulHub initializes a new hub.
@@ -45,19 +56,78 @@ func (h *ConsulHub) Run() {
 		select {
 
 		case c := <-h.register:
+			h.lock.Lock()
 			h.connections[c] = true
+			h.lock.Unlock()
 
 		case c := <-h.unregister:
+			h.lock.Lock()
 			if _, ok := h.connections[c]; ok {
 				delete(h.connections, c)
-				close(c.send)
 			}
+			h.lock.Unlock()
 		}
 	}
 }
 
+// region returns the region of the given name
+func (h *ConsulHub) region(name string) (*ConsulRegion, bool) {
+	region, ok := (*h.clients)[name]
+	return region, ok
+}
+
+// stats returns the number of active connections and the total number of watches they hold
+func (h *ConsulHub) stats() (connections int, watches int) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	for c := range h.connections {
+		watches += c.watches.Size()
+	}
+
+	return len(h.connections), watches
+}
+
+// Shutdown closes all websocket connections, and waits for their handlers and watches to exit
+// or for ctx to be done. New connections are refused from then on. Closing a connection aborts
+// its in-flight Consul requests, so watches exit right away rather than at the end of their
+// blocking queries.
+func (h *ConsulHub) Shutdown(ctx context.Context) error {
+	h.lock.Lock()
+	h.shuttingDown = true
+	for c := range h.connections {
+		// the writePump sends the close message once the connection is cancelled
+		c.cancel()
+	}
+	h.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.routines.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Handler establishes the websocket connection and calls the connection handler.
 func (h *ConsulHub) Handler(w http.ResponseWriter, r *http.Request) {
+	h.lock.RLock()
+	if h.shuttingDown {
+		h.lock.RUnlock()
+		http.Error(w, "hashi-ui is shutting down.", http.StatusServiceUnavailable)
+		return
+	}
+	h.routines.Add(1)
+	h.lock.RUnlock()
+
+	defer h.routines.Done()
+
 	socket, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		logger.Errorf("transport: websocket upgrade failed: %s", err)
@@ -79,7 +149,8 @@ func (h *ConsulHub) Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c := NewConsulConnection(h, socket, (*h.clients)[region], (*h.channels)[region])
+	consulRegion := (*h.clients)[region]
+	c := NewConsulConnection(h, socket, consulRegion, (*h.channels)[region], consulRegion.Config.ConsulSendBuffer)
 	c.Handle()
 }
 
@@ -121,3 +192,51 @@ func (h *ConsulHub) sendAction(socket *websocket.Conn, action *Action) {
 		logger.Errorf(" %s", err)
 	}
 }
+
+// downloadSnapshot streams a Consul snapshot of the region to the client. The
+// ACL token must be given in the X-Consul-Token header, the configured token is
+// never used as the snapshot holds every ACL token and KV secret. Consul only
+// allows management tokens to take snapshots.
+func (h *ConsulHub) downloadSnapshot(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	region := params["region"]
+
+	regionClient, ok := (*h.clients)[region]
+	if !ok {
+		logger.Errorf("region was not found: %s", region)
+		http.Error(w, "Unknown region.", http.StatusNotFound)
+		return
+	}
+
+	token := r.Header.Get("X-Consul-Token")
+	if token == "" {
+		logger.Warningf("download: refusing snapshot of %s without an ACL token", region)
+		http.Error(w, "An ACL token is required in the X-Consul-Token header.", http.StatusUnauthorized)
+		return
+	}
+
+	snapshot, _, err := regionClient.Client.Snapshot().Save(&api.QueryOptions{Token: token})
+	if err != nil {
+		logger.Errorf("Unable to save snapshot: %s", err)
+
+		if isPermissionDenied(err) {
+			http.Error(w, "The ACL token is not allowed to take snapshots.", http.StatusForbidden)
+			return
+		}
+
+		http.Error(w, "Could not save the snapshot.", http.StatusInternalServerError)
+		return
+	}
+	defer snapshot.Close()
+
+	filename := fmt.Sprintf("consul-%s-%s.snap", region, time.Now().UTC().Format("20060102-150405"))
+
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	logger.Infof("download: streaming snapshot %q to client", filename)
+
+	if _, err := io.Copy(w, snapshot); err != nil {
+		logger.Errorf("download: unable to stream snapshot %q: %s", filename, err)
+	}
+}
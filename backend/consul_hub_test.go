@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConsulHubShutdownAbortsWatches(t *testing.T) {
+	// a blocking query answering only after the Consul wait time, or when the client goes away
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Minute):
+		}
+	}))
+	defer server.Close()
+
+	c := newTestConsulConnection()
+	h := c.hub
+	h.connections[c] = true
+
+	client := &http.Client{Transport: &consulContextTransport{contextOf: c.requestContext, base: http.DefaultTransport}}
+	for i := 0; i < 3; i++ {
+		c.startWatch(func() {
+			if resp, err := client.Get(server.URL + "/v1/health/service/web?index=42&wait=120000ms"); err == nil {
+				resp.Body.Close()
+			}
+		})
+	}
+
+	// let the watches send their query
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	started := time.Now()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown didn't complete: %s", err)
+	}
+
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("shutdown took %s, the blocking queries weren't aborted", elapsed)
+	}
+}
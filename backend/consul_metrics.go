@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// consulMetrics holds the process wide Consul counters. The plain counters are updated
+// atomically, the per watch type ones under the lock.
+var consulMetrics = &consulMetricSet{broadcasts: make(map[string]*consulBroadcastMetric)}
+
+type consulMetricSet struct {
+	actionsSent       uint64
+	watchErrors       uint64
+	broadcastsSkipped uint64
+
+	// broadcasts counts the watch updates by action type, which tells the kind of watch apart
+	// without labelling every key (a KV prefix, a node...) watched by a connection
+	lock       sync.Mutex
+	broadcasts map[string]*consulBroadcastMetric
+}
+
+// consulBroadcastMetric counts the watch updates of an action type, and the last Consul index
+// one was sent at
+type consulBroadcastMetric struct {
+	sent      uint64
+	lastIndex uint64
+}
+
+// recordBroadcast counts a watch update of the action type sent at index
+func (m *consulMetricSet) recordBroadcast(actionType string, index uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	metric, ok := m.broadcasts[actionType]
+	if !ok {
+		metric = &consulBroadcastMetric{}
+		m.broadcasts[actionType] = metric
+	}
+
+	metric.sent++
+	if index > 0 {
+		metric.lastIndex = index
+	}
+}
+
+// metricsHandler exposes the Consul connection metrics in the Prometheus text format
+func (h *ConsulHub) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	connections, watches := h.stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "hashi_ui_consul_connections", "gauge", "Number of active Consul websocket connections.", uint64(connections))
+	writeMetric(w, "hashi_ui_consul_watches", "gauge", "Number of watches registered by all Consul connections.", uint64(watches))
+	writeMetric(w, "hashi_ui_consul_actions_sent_total", "counter", "Number of actions sent to Consul websocket connections.", atomic.LoadUint64(&consulMetrics.actionsSent))
+	writeMetric(w, "hashi_ui_consul_watch_errors_total", "counter", "Number of failed Consul watch queries.", atomic.LoadUint64(&consulMetrics.watchErrors))
+	writeMetric(w, "hashi_ui_consul_broadcasts_skipped_total", "counter", "Number of broadcast updates skipped for lagging Consul websocket connections.", atomic.LoadUint64(&consulMetrics.broadcastsSkipped))
+
+	consulMetrics.lock.Lock()
+	types := make([]string, 0, len(consulMetrics.broadcasts))
+	sent := make(map[string]uint64, len(consulMetrics.broadcasts))
+	lastIndex := make(map[string]uint64, len(consulMetrics.broadcasts))
+	for actionType, metric := range consulMetrics.broadcasts {
+		types = append(types, actionType)
+		sent[actionType] = metric.sent
+		lastIndex[actionType] = metric.lastIndex
+	}
+	consulMetrics.lock.Unlock()
+
+	sort.Strings(types)
+
+	writeMetricHeader(w, "hashi_ui_consul_watch_broadcasts_total", "counter", "Number of updates sent by Consul watches, by watch type.")
+	for _, actionType := range types {
+		writeLabeledMetric(w, "hashi_ui_consul_watch_broadcasts_total", "type", actionType, sent[actionType])
+	}
+
+	writeMetricHeader(w, "hashi_ui_consul_watch_last_index", "gauge", "Consul index of the last update sent by Consul watches, by watch type.")
+	for _, actionType := range types {
+		writeLabeledMetric(w, "hashi_ui_consul_watch_last_index", "type", actionType, lastIndex[actionType])
+	}
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value uint64) {
+	writeMetricHeader(w, name, kind, help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func writeMetricHeader(w http.ResponseWriter, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeLabeledMetric(w http.ResponseWriter, name, label, labelValue string, value uint64) {
+	fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, labelValue, value)
+}
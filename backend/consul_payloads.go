@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	api "github.com/hashicorp/consul/api"
+)
+
+// consulRawAction is an action as received from the client, with the payload left undecoded
+// until the action type tells what it should be decoded into.
+type consulRawAction struct {
+	Type      string
+	Index     uint64
+	Payload   json.RawMessage
+	RequestID string
+}
+
+// ConsulWatchPayload is the payload of the watches keyed by a single string (node, KV path, ...).
+// It is either the plain key, or an object with the key and the sinceIndex a reconnecting
+// client last saw, so the watch only sends what changed after it.
+type ConsulWatchPayload struct {
+	Key        string `json:"key"`
+	SinceIndex uint64 `json:"sinceIndex"`
+}
+
+// UnmarshalJSON accepts both the plain string and the object form of the payload
+func (p *ConsulWatchPayload) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.Key); err == nil {
+		return nil
+	}
+
+	type watchPayload ConsulWatchPayload
+	if err := json.Unmarshal(data, (*watchPayload)(p)); err != nil {
+		return fmt.Errorf("expected a string or an object with a key: %s", err)
+	}
+
+	return nil
+}
+
+// ConsulChecksInStatePayload is the payload of WATCH_CONSUL_CHECKS_IN_STATE. It is either the
+// plain state, or an object with the state, a sinceIndex and a coalescing window in milliseconds:
+// changes within the window are merged, and only the state at its end is sent.
+type ConsulChecksInStatePayload struct {
+	State      string `json:"state"`
+	SinceIndex uint64 `json:"sinceIndex"`
+	Window     int    `json:"window"`
+}
+
+// UnmarshalJSON accepts both the plain string and the object form of the payload
+func (p *ConsulChecksInStatePayload) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.State); err == nil {
+		return nil
+	}
+
+	type checksInStatePayload ConsulChecksInStatePayload
+	if err := json.Unmarshal(data, (*checksInStatePayload)(p)); err != nil {
+		return fmt.Errorf("expected a string or an object with a state: %s", err)
+	}
+
+	return nil
+}
+
+// ConsulClientHelloPayload is the payload of CLIENT_HELLO, the capabilities a client announces
+// once connected. Settings left out keep their defaults.
+type ConsulClientHelloPayload struct {
+	Batch            *bool   `json:"batch"`
+	BatchWindow      *int    `json:"batchWindow"`
+	Compression      *bool   `json:"compression"`
+	ThrottleInterval *int    `json:"throttleInterval"`
+	GzipPayloads     *bool   `json:"gzipPayloads"`
+	QueryMeta        *bool   `json:"queryMeta"`
+	LastSeq          *uint64 `json:"lastSeq"`
+}
+
+// ConsulIntentionPayload is the payload of CREATE_CONSUL_INTENTION
+type ConsulIntentionPayload struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Action      string `json:"action"`
+	Description string `json:"description"`
+}
+
+// ConsulKVPairPayload is the payload of the check-and-set SET_CONSUL_KV_PAIR and
+// DELETE_CONSUL_KV_PAIR actions
+type ConsulKVPairPayload struct {
+	Path  string `json:"path"`
+	Value string `json:"value"`
+	Index uint64 `json:"index"`
+}
+
+// ConsulKVPayload is the payload of SET_CONSUL_KV. When ModifyIndex is given the write is a
+// check-and-set, and only succeeds if the key wasn't modified since (0 means not existing yet).
+// When Session is given the key is acquired by the session instead, and deleted or released
+// (depending on the session behavior) when it ends.
+type ConsulKVPayload struct {
+	Key         string  `json:"key"`
+	Value       string  `json:"value"`
+	ModifyIndex *uint64 `json:"modifyIndex"`
+	Session     string  `json:"session"`
+	Flags       uint64  `json:"flags"`
+}
+
+// ConsulKVTreePayload is the payload of DELETE_CONSUL_KV_TREE
+type ConsulKVTreePayload struct {
+	Prefix string `json:"prefix"`
+}
+
+// ConsulTxnPayload is the payload of CONSUL_TXN, KV operations applied atomically
+type ConsulTxnPayload struct {
+	Ops []ConsulTxnOpPayload `json:"ops"`
+}
+
+// ConsulTxnOpPayload is a single operation of a CONSUL_TXN: a set, delete or cas of a key. The
+// index of a cas is the ModifyIndex the key must still have.
+type ConsulTxnOpPayload struct {
+	Verb  string `json:"verb"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Index uint64 `json:"index"`
+}
+
+// ConsulServiceCheckPayload is the payload of DEREGISTER_CONSUL_SERVICE_CHECK
+type ConsulServiceCheckPayload struct {
+	NodeAddress string `json:"nodeAddress"`
+	CheckID     string `json:"checkID"`
+}
+
+// ConsulMaintenancePayload is the payload of the node and service maintenance toggles
+type ConsulMaintenancePayload struct {
+	NodeName    string `json:"nodeName"`
+	NodeAddress string `json:"nodeAddress"`
+	ServiceID   string `json:"serviceID"`
+	Enable      bool   `json:"enable"`
+	Reason      string `json:"reason"`
+}
+
+// ConsulNodeRTTPayload is the payload of FETCH_CONSUL_NODE_RTT
+type ConsulNodeRTTPayload struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+// ConsulACLTokenPayload is the payload of CREATE_CONSUL_ACL_TOKEN
+type ConsulACLTokenPayload struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Rules string `json:"rules"`
+}
+
+// ConsulEventPayload is the payload of FIRE_CONSUL_EVENT
+type ConsulEventPayload struct {
+	Name    string `json:"name"`
+	Payload string `json:"payload"`
+}
+
+func newStringPayload() interface{}  { return new(string) }
+func newBoolPayload() interface{}    { return new(bool) }
+func newWatchPayload() interface{}   { return &ConsulWatchPayload{} }
+func newStringsPayload() interface{} { return new([]string) }
+
+// consulPayloads maps the action types sent by the client to a constructor of the value their
+// payload is decoded into. Actions not listed here, like the ones accepting either a string or
+// an object, get the generic JSON decoding.
+//
+// A sinceIndex given in the payload of a watch ends up as the Index of the decoded action.
+var consulPayloads = map[string]func() interface{}{
+	setConsulToken:      newStringPayload,
+	clientHello:         func() interface{} { return &ConsulClientHelloPayload{} },
+	setConsulAllowStale: newBoolPayload,
+	setConsulDatacenter: newStringPayload,
+	setConsulNamespace:  newStringPayload,
+	refreshConsulWatch:  newStringPayload,
+	searchConsul:        newStringPayload,
+
+	watchConsulServicesMultiRegion:   newStringsPayload,
+	unwatchConsulServicesMultiRegion: newStringsPayload,
+	watchConsulServiceGroup:          newStringsPayload,
+	unwatchConsulServiceGroup:        newStringsPayload,
+	watchConsulServiceAllDC:          newStringPayload,
+	unwatchConsulServiceAllDC:        newStringPayload,
+
+	registerConsulService:          func() interface{} { return &api.AgentServiceRegistration{} },
+	dereigsterConsulServiceCheck:   func() interface{} { return &ConsulServiceCheckPayload{} },
+	toggleConsulNodeMaintenance:    func() interface{} { return &ConsulMaintenancePayload{} },
+	toggleConsulServiceMaintenance: func() interface{} { return &ConsulMaintenancePayload{} },
+
+	watchConsulNode:            newWatchPayload,
+	unwatchConsulNode:          newStringPayload,
+	watchConsulNodeServices:    newWatchPayload,
+	unwatchConsulNodeServices:  newStringPayload,
+	watchConsulChecksInState:   func() interface{} { return &ConsulChecksInStatePayload{} },
+	unwatchConsulChecksInState: newStringPayload,
+	watchConsulServiceChecks:   newWatchPayload,
+	unwatchConsulServiceChecks: newStringPayload,
+
+	createConsulIntention: func() interface{} { return &ConsulIntentionPayload{} },
+	deleteConsulIntention: newStringPayload,
+
+	watchConsulKVPath:     newWatchPayload,
+	unwatchConsulKVPath:   newStringPayload,
+	setConsulKVPair:       func() interface{} { return &ConsulKVPairPayload{} },
+	deleteConsulKvFolder:  newStringPayload,
+	getConsulKVPair:       newStringPayload,
+	deleteConsulKvPair:    func() interface{} { return &ConsulKVPairPayload{} },
+	watchConsulKVPrefix:   newWatchPayload,
+	unwatchConsulKVPrefix: newStringPayload,
+	watchConsulLocks:      newWatchPayload,
+	unwatchConsulLocks:    newStringPayload,
+	watchConsulKV:         newWatchPayload,
+	unwatchConsulKV:       newStringPayload,
+	setConsulKV:           func() interface{} { return &ConsulKVPayload{} },
+	deleteConsulKV:        newStringPayload,
+	deleteConsulKVTree:    func() interface{} { return &ConsulKVTreePayload{} },
+	consulTxn:             func() interface{} { return &ConsulTxnPayload{} },
+
+	executeConsulPreparedQuery: newStringPayload,
+	destroyConsulSession:       newStringPayload,
+
+	watchConsulMembers:   newBoolPayload,
+	unwatchConsulMembers: newBoolPayload,
+	fetchConsulNodeRTT:   func() interface{} { return &ConsulNodeRTTPayload{} },
+	fireConsulEvent:      func() interface{} { return &ConsulEventPayload{} },
+
+	createConsulACLToken: func() interface{} { return &ConsulACLTokenPayload{} },
+	deleteConsulACLToken: newStringPayload,
+	readConsulACLToken:   newStringPayload,
+}
+
+// decodeConsulAction decodes the payload of a raw action into the type registered for it in
+// consulPayloads. Strings, booleans and watch keys are handed out by value, everything else
+// as a pointer.
+func decodeConsulAction(raw consulRawAction) (Action, error) {
+	action := Action{Type: raw.Type, Index: raw.Index, RequestID: raw.RequestID}
+
+	if len(raw.Payload) == 0 {
+		return action, nil
+	}
+
+	newPayload, ok := consulPayloads[raw.Type]
+	if !ok {
+		if err := json.Unmarshal(raw.Payload, &action.Payload); err != nil {
+			return action, err
+		}
+
+		if params, ok := action.Payload.(map[string]interface{}); ok {
+			if sinceIndex, ok := params["sinceIndex"].(float64); ok && sinceIndex > 0 {
+				action.Index = uint64(sinceIndex)
+			}
+		}
+
+		return action, nil
+	}
+
+	payload := newPayload()
+	if err := json.Unmarshal(raw.Payload, payload); err != nil {
+		return action, err
+	}
+
+	switch value := payload.(type) {
+	case *string:
+		action.Payload = *value
+	case *bool:
+		action.Payload = *value
+	case *[]string:
+		action.Payload = *value
+	case *ConsulWatchPayload:
+		action.Payload = value.Key
+		if value.SinceIndex > 0 {
+			action.Index = value.SinceIndex
+		}
+	case *ConsulChecksInStatePayload:
+		action.Payload = payload
+		if value.SinceIndex > 0 {
+			action.Index = value.SinceIndex
+		}
+	default:
+		action.Payload = payload
+	}
+
+	return action, nil
+}
@@ -1,6 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	api "github.com/hashicorp/consul/api"
@@ -27,6 +37,10 @@ type ConsulServices map[string]*ConsulService
 type ConsulRegionBroadcastChannels struct {
 	services observer.Property
 	nodes    observer.Property
+
+	// the last updates of each channel, replayed to new subscribers
+	servicesHistory *actionRing
+	nodesHistory    *actionRing
 }
 
 // ConsulRegion keeps track of the ConsulRegion state. It monitors changes to allocations,
@@ -35,16 +49,28 @@ type ConsulRegionBroadcastChannels struct {
 type ConsulRegion struct {
 	Config            *Config
 	Client            *api.Client
+	RequestClient     *api.Client
+	statusClient      *api.Client
+	Datacenter        string
 	broadcastChannels *ConsulRegionBroadcastChannels
 	regions           []string
 	services          *ConsulInternalServices
 	nodes             *ConsulInternalNodes
+
+	agentSelf          *ConsulAgentSelf
+	agentSelfFetchedAt time.Time
+	agentSelfLock      sync.Mutex
 }
 
+// consulAgentSelfTTL is how long the agent self information is cached, it only changes when
+// the agent is reconfigured or upgraded
+const consulAgentSelfTTL = 1 * time.Minute
+
 // ConsulInternalService ...
 type ConsulInternalService struct {
 	Name           string
 	Nodes          []string
+	Tags           []string
 	ChecksPassing  int64
 	ChecksWarning  int64
 	ChecksCritical int64
@@ -53,38 +79,557 @@ type ConsulInternalService struct {
 // ConsulInternalServices ...
 type ConsulInternalServices []*ConsulInternalService
 
+// ConsulConnectService is a service of the mesh: a Connect proxy or gateway (Kind is set), or a
+// service fronted by one. Consul versions without Connect never report any.
+type ConsulConnectService struct {
+	ConsulInternalService
+	Kind                 string
+	ConnectedWithProxy   bool
+	ConnectedWithGateway bool
+}
+
 // ConsulInternalNode ...
 type ConsulInternalNode struct {
 	Node            string
 	Address         string
 	TaggedAddresses map[string]string
+	Meta            map[string]string
 	Services        []*api.AgentService
 	Checks          []*api.AgentCheck
 }
 
+// ConsulNodeServices are the services registered on a node, sorted by ID
+type ConsulNodeServices struct {
+	Node     string
+	Services []*api.AgentService
+}
+
+// ConsulServiceEntry is a health service entry with the service fields newer than the vendored
+// API client (meta, tagged addresses and weights), which its ServiceEntry would drop
+type ConsulServiceEntry struct {
+	Node    *api.Node
+	Service *ConsulAgentService
+	Checks  api.HealthChecks
+}
+
+// ConsulAgentService is a service instance, along with its meta, its LAN and WAN addresses, and
+// its DNS weights
+type ConsulAgentService struct {
+	api.AgentService
+	Meta            map[string]string
+	TaggedAddresses map[string]ConsulServiceAddress
+	Weights         *ConsulServiceWeights
+}
+
+// ConsulServiceAddress is one of the tagged addresses of a service
+type ConsulServiceAddress struct {
+	Address string
+	Port    int
+}
+
+// ConsulServiceWeights are the DNS SRV weights of a service, depending on its health
+type ConsulServiceWeights struct {
+	Passing int
+	Warning int
+}
+
+// ConsulLock is a KV key held by a session, as done by the Consul locks and semaphores. Session
+// is nil when the holding session couldn't be found (i.e. it was invalidated in the meantime).
+type ConsulLock struct {
+	Key       string
+	LockIndex uint64
+	Flags     uint64
+	SessionID string
+	Session   *api.SessionEntry
+}
+
 // ConsulInternalNodes ...
 type ConsulInternalNodes []*ConsulInternalNode
 
+// ConsulNodeHealth is a node along with the aggregated status of all its checks: critical if any
+// check is critical, warning if any is warning, passing otherwise
+type ConsulNodeHealth struct {
+	*ConsulInternalNode
+	Health string
+}
+
+// aggregatedHealth returns the worst status of the node checks
+func (n *ConsulInternalNode) aggregatedHealth() string {
+	health := api.HealthPassing
+
+	for _, check := range n.Checks {
+		switch check.Status {
+		case api.HealthCritical:
+			return api.HealthCritical
+		case api.HealthWarning:
+			health = api.HealthWarning
+		}
+	}
+
+	return health
+}
+
+// ConsulServiceGroupHealth rolls up the health of the instances of a service of a group: the
+// number of instances by aggregated status, and the worst of these as Health
+type ConsulServiceGroupHealth struct {
+	Health   string
+	Passing  int
+	Warning  int
+	Critical int
+	Entries  []*api.ServiceEntry
+}
+
+// newConsulServiceGroupHealth aggregates the checks of every instance of a service
+func newConsulServiceGroupHealth(entries []*api.ServiceEntry) *ConsulServiceGroupHealth {
+	group := &ConsulServiceGroupHealth{Health: api.HealthPassing, Entries: entries}
+
+	for _, entry := range entries {
+		health := api.HealthPassing
+		for _, check := range entry.Checks {
+			if check.Status == api.HealthCritical {
+				health = api.HealthCritical
+				break
+			}
+			if check.Status == api.HealthWarning {
+				health = api.HealthWarning
+			}
+		}
+
+		switch health {
+		case api.HealthCritical:
+			group.Critical++
+			group.Health = api.HealthCritical
+		case api.HealthWarning:
+			group.Warning++
+			if group.Health != api.HealthCritical {
+				group.Health = api.HealthWarning
+			}
+		default:
+			group.Passing++
+		}
+	}
+
+	return group
+}
+
+// ConsulServiceDatacenterHealth is the health of a service in a datacenter. A datacenter failing
+// to answer isn't Reachable, and keeps the last health known for it.
+type ConsulServiceDatacenterHealth struct {
+	*ConsulServiceGroupHealth
+	Reachable bool
+	Error     string `json:",omitempty"`
+}
+
+// ConsulServiceAllDC is the health of a service in every datacenter, keyed by datacenter
+type ConsulServiceAllDC struct {
+	Service     string
+	Datacenters map[string]*ConsulServiceDatacenterHealth
+}
+
+// ConsulDatacenters is the live list of datacenters known to the Consul agent. Error is set
+// when only the local datacenter could be determined
+type ConsulDatacenters struct {
+	Datacenters []string
+	Error       string
+}
+
+// ConsulRegionStatus tells whether the Consul servers of a region answer and have a leader,
+// and how long they took to answer in milliseconds
+type ConsulRegionStatus struct {
+	Region    string
+	Reachable bool
+	Leader    string
+	Latency   int64
+	Error     string `json:",omitempty"`
+}
+
+// ConsulSearchResults are the service names, node names and KV keys matching a search query.
+// Truncated is set when any category had more matches than returned.
+type ConsulSearchResults struct {
+	Query     string
+	Services  []string
+	Nodes     []string
+	Keys      []string
+	Truncated bool
+}
+
+// ConnectionStats is the payload of the periodic CONNECTION_STATS action, letting the UI check
+// the connection is alive end to end and see which watches it runs
+type ConnectionStats struct {
+	ServerTime time.Time
+	Watches    []string
+	Version    string
+}
+
+// ConsulWatchStatus is the health of a single watch of a connection: the index and time of its
+// last successful query, its last error and when it last sent an update to the client. A watch
+// stuck in errors has a LastError newer than LastSuccess.
+type ConsulWatchStatus struct {
+	WatchKey      string
+	LastIndex     uint64
+	LastSuccess   time.Time
+	LastError     string
+	LastErrorTime time.Time
+	LastBroadcast time.Time
+}
+
+// WatchHeartbeat is sent after every successful query of a watch, changed or not, with the index
+// the watch blocks at next
+type WatchHeartbeat struct {
+	WatchKey string
+	Index    uint64
+	Time     time.Time
+}
+
+// ConsulKVWriteResult is the outcome of SET_CONSUL_KV. Success is false when a check-and-set
+// write (CAS set) lost against a concurrent modification of the key, or when the key couldn't
+// be acquired by Session because another session holds it.
+type ConsulKVWriteResult struct {
+	Key     string
+	CAS     bool
+	Session string `json:",omitempty"`
+	Success bool
+}
+
+// ConsulTxnResult is the outcome of CONSUL_TXN. When Success is false no operation was applied,
+// and Errors tells which of them failed and why.
+type ConsulTxnResult struct {
+	Success bool
+	Results []*api.KVPair
+	Errors  api.TxnErrors
+}
+
+// ConsulKVTreeDeleted confirms a DELETE_CONSUL_KV_TREE, Recursive tells the UI every key below
+// Prefix is gone and not just the key itself
+type ConsulKVTreeDeleted struct {
+	Prefix    string
+	Recursive bool
+}
+
+// ConsulWatchEvent is the payload of CONSUL_WATCH_STARTED and CONSUL_WATCH_STOPPED. Duplicate is
+// set when a watch was requested while the connection was already subscribed to it.
+type ConsulWatchEvent struct {
+	WatchKey  string
+	Duplicate bool `json:",omitempty"`
+}
+
+// ConsulRaftConfiguration is the raft peer set of the Consul servers, along with the current
+// leader and the number of voters the UI needs to tell a healthy quorum apart
+type ConsulRaftConfiguration struct {
+	Servers []*api.RaftServer
+	Index   uint64
+	Leader  string
+	Voters  int
+}
+
+// newConsulRaftConfiguration summarizes a raft configuration
+func newConsulRaftConfiguration(configuration *api.RaftConfiguration) *ConsulRaftConfiguration {
+	result := &ConsulRaftConfiguration{Servers: configuration.Servers, Index: configuration.Index}
+
+	if result.Servers == nil {
+		result.Servers = make([]*api.RaftServer, 0)
+	}
+
+	for _, server := range result.Servers {
+		if server.Leader {
+			result.Leader = server.Node
+		}
+
+		if server.Voter {
+			result.Voters++
+		}
+	}
+
+	return result
+}
+
+// ConsulHealthSummary is the numbers of the cluster overview: services, their instances (as
+// service and node pairs), nodes and the service checks by status
+type ConsulHealthSummary struct {
+	Services       int
+	Instances      int
+	Nodes          int
+	ChecksPassing  int64
+	ChecksWarning  int64
+	ChecksCritical int64
+}
+
+// healthSummary sums up the current services and nodes of the region
+func (c *ConsulRegion) healthSummary() *ConsulHealthSummary {
+	summary := &ConsulHealthSummary{}
+
+	if services := c.services; services != nil {
+		summary.Services = len(*services)
+
+		for _, service := range *services {
+			summary.Instances += len(service.Nodes)
+			summary.ChecksPassing += service.ChecksPassing
+			summary.ChecksWarning += service.ChecksWarning
+			summary.ChecksCritical += service.ChecksCritical
+		}
+	}
+
+	if nodes := c.nodes; nodes != nil {
+		summary.Nodes = len(*nodes)
+	}
+
+	return summary
+}
+
+// ConsulAgentSelf is the configuration of the Consul agent hashi-ui talks to, as returned by
+// /v1/agent/self, along with the few flags the UI uses to toggle features
+type ConsulAgentSelf struct {
+	Version        string
+	Datacenter     string
+	NodeName       string
+	Server         bool
+	ACLsEnabled    bool
+	ConnectEnabled bool
+	Config         map[string]interface{}
+	Member         map[string]interface{}
+}
+
+// ConsulACLToken is a legacy Consul ACL token as listed to the UI. The ID of a legacy token is
+// its secret, so it is replaced by a Handle derived from it, and only revealed on request.
+type ConsulACLToken struct {
+	Handle      string
+	Name        string
+	Type        string
+	Rules       string
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// consulACLHandle derives the handle identifying a token in the UI from its secret ID
+func consulACLHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// newConsulACLToken redacts an ACL entry into a ConsulACLToken
+func newConsulACLToken(entry *api.ACLEntry) *ConsulACLToken {
+	return &ConsulACLToken{
+		Handle:      consulACLHandle(entry.ID),
+		Name:        entry.Name,
+		Type:        entry.Type,
+		Rules:       entry.Rules,
+		CreateIndex: entry.CreateIndex,
+		ModifyIndex: entry.ModifyIndex,
+	}
+}
+
+// ConsulIntention is a Consul Connect intention, as returned by /v1/connect/intentions
+type ConsulIntention struct {
+	ID              string `json:",omitempty"`
+	Description     string `json:",omitempty"`
+	SourceNS        string `json:",omitempty"`
+	SourceName      string
+	DestinationNS   string `json:",omitempty"`
+	DestinationName string
+	SourceType      string `json:",omitempty"`
+	Action          string
+	Meta            map[string]string `json:",omitempty"`
+	Precedence      int               `json:",omitempty"`
+	CreateIndex     uint64            `json:",omitempty"`
+	ModifyIndex     uint64            `json:",omitempty"`
+}
+
+// ConsulKVPairValue is the state of a single watched KV key. Value is base64 encoded
+// in JSON and null when the key does not exist (or was deleted)
+type ConsulKVPairValue struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	ModifyIndex uint64
+}
+
+// ConsulNodeRTT is the estimated round trip time between two nodes, computed from their
+// network coordinates
+type ConsulNodeRTT struct {
+	Source      string
+	Destination string
+	RTT         float64 // milliseconds
+	Error       string  `json:",omitempty"`
+}
+
+// ConsulMaintenanceState is the maintenance mode of a node, or of a service on it when
+// ServiceID is set
+type ConsulMaintenanceState struct {
+	Node      string
+	ServiceID string `json:",omitempty"`
+	Enabled   bool
+	Reason    string `json:",omitempty"`
+}
+
+// ConsulAgentMember is a serf gossip member as seen by the Consul agent, with the
+// numeric serf status translated to alive, leaving, left or failed
+type ConsulAgentMember struct {
+	Name   string
+	Addr   string
+	Port   uint16
+	Tags   map[string]string
+	Status string
+}
+
+// consulMemberStatus maps serf.MemberStatus values to their names
+var consulMemberStatus = map[int]string{
+	0: "none",
+	1: "alive",
+	2: "leaving",
+	3: "left",
+	4: "failed",
+}
+
 // CreateConsulRegionClient ...
 func CreateConsulRegionClient(c *Config, region string) (*api.Client, error) {
-	config := api.DefaultConfig()
-	config.Address = c.ConsulAddress
-	config.WaitTime = waitTime
+	config, err := consulAPIConfig(c, c.ConsulAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	config.WaitTime = c.ConsulWaitTime
+	config.Datacenter = region
+	config.Token = c.ConsulACLToken
+
+	return api.NewClient(config)
+}
+
+// CreateConsulRequestClient creates a client for the one-shot requests of a region, which
+// aborts the requests still unanswered after timeout (none when 0). Blocking queries wait for up
+// to ConsulWaitTime and use the client of CreateConsulRegionClient instead.
+func CreateConsulRequestClient(c *Config, region string, timeout time.Duration) (*api.Client, error) {
+	config, err := consulAPIConfig(c, c.ConsulAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Datacenter = region
+	config.Token = c.ConsulACLToken
+	setRequestTimeout(config, timeout)
+
+	return api.NewClient(config)
+}
+
+// setRequestTimeout makes the client of config abort the requests still unanswered after
+// timeout (none when 0), on a copy of its HTTP client as that may be shared
+func setRequestTimeout(config *api.Config, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	httpClient := &http.Client{}
+	if config.HttpClient != nil {
+		*httpClient = *config.HttpClient
+	}
+	httpClient.Timeout = timeout
+	config.HttpClient = httpClient
+}
+
+// consulNamespaceTransport adds the ns parameter of Consul Enterprise namespaces to every request,
+// as the QueryOptions and WriteOptions of the vendored API client have no field for it
+type consulNamespaceTransport struct {
+	namespace string
+	base      http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper, on a copy of req as round trippers mustn't modify it
+func (t *consulNamespaceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scoped := new(http.Request)
+	*scoped = *req
+
+	u := *req.URL
+	params := u.Query()
+	params.Set("ns", t.namespace)
+	u.RawQuery = params.Encode()
+	scoped.URL = &u
+
+	return t.base.RoundTrip(scoped)
+}
+
+// consulContextTransport runs every request under the context contextOf returns for it, as the
+// vendored API client has no way to cancel a request, blocking queries included
+type consulContextTransport struct {
+	contextOf func(req *http.Request) context.Context
+	base      http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *consulContextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.contextOf(req)))
+}
+
+// CreateConsulConnectionClient creates a client of a region for a single websocket connection,
+// like CreateConsulRegionClient (timeout 0) or CreateConsulRequestClient do for the region. Its
+// requests run under the context contextOf returns for them, so they are aborted with the
+// connection, and are scoped to a Consul Enterprise namespace when one is given.
+func CreateConsulConnectionClient(c *Config, region string, namespace string, timeout time.Duration, contextOf func(req *http.Request) context.Context) (*api.Client, error) {
+	config, err := consulAPIConfig(c, c.ConsulAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	config.WaitTime = c.ConsulWaitTime
 	config.Datacenter = region
-	// config.TLSConfig = &api.TLSConfig{
-	// 	CACert:     c.CACert,
-	// 	ClientCert: c.ClientCert,
-	// 	ClientKey:  c.ClientKey,
-	// }
+	config.Token = c.ConsulACLToken
+
+	httpClient := &http.Client{}
+	if config.HttpClient != nil {
+		*httpClient = *config.HttpClient
+	}
+
+	base := httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if namespace != "" {
+		base = &consulNamespaceTransport{namespace: namespace, base: base}
+	}
+
+	httpClient.Transport = &consulContextTransport{contextOf: contextOf, base: base}
+	httpClient.Timeout = timeout
+	config.HttpClient = httpClient
 
 	return api.NewClient(config)
 }
 
+// consulAPIConfig returns the API client config to reach the Consul agent at address, over the
+// shared TLS transport when TLS is configured
+func consulAPIConfig(c *Config, address string) (*api.Config, error) {
+	scheme, transport, err := consulHTTPTransport(c)
+	if err != nil {
+		return nil, err
+	}
+
+	config := api.DefaultConfig()
+	config.Address = address
+	config.Scheme = scheme
+
+	if transport != nil {
+		config.HttpClient = &http.Client{Transport: transport}
+	}
+
+	return config, nil
+}
+
 // NewConsulRegion configures the Consul API client and initializes the internal state.
-func NewConsulRegion(c *Config, client *api.Client, channels *ConsulRegionBroadcastChannels) (*ConsulRegion, error) {
+func NewConsulRegion(c *Config, datacenter string, client *api.Client, channels *ConsulRegionBroadcastChannels) (*ConsulRegion, error) {
+	requestClient, err := CreateConsulRequestClient(c, datacenter, c.ConsulRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	statusClient, err := CreateConsulRequestClient(c, datacenter, consulRegionStatusTimeout)
+	if err != nil {
+		return nil, err
+	}
+
 	return &ConsulRegion{
 		Config:            c,
 		Client:            client,
+		RequestClient:     requestClient,
+		statusClient:      statusClient,
+		Datacenter:        datacenter,
 		broadcastChannels: channels,
 		regions:           make([]string, 0),
 		services:          &ConsulInternalServices{},
@@ -92,6 +637,44 @@ func NewConsulRegion(c *Config, client *api.Client, channels *ConsulRegionBroadc
 	}, nil
 }
 
+// fetchAgentSelf returns the agent self information, fetching it at most once per consulAgentSelfTTL
+func (c *ConsulRegion) fetchAgentSelf() (*ConsulAgentSelf, error) {
+	c.agentSelfLock.Lock()
+	defer c.agentSelfLock.Unlock()
+
+	if c.agentSelf != nil && time.Since(c.agentSelfFetchedAt) < consulAgentSelfTTL {
+		return c.agentSelf, nil
+	}
+
+	self, err := c.RequestClient.Agent().Self()
+	if err != nil {
+		return nil, err
+	}
+
+	config := self["Config"]
+	debugConfig := self["DebugConfig"]
+
+	result := &ConsulAgentSelf{Config: config, Member: self["Member"]}
+	result.Version, _ = config["Version"].(string)
+	result.Datacenter, _ = config["Datacenter"].(string)
+	result.NodeName, _ = config["NodeName"].(string)
+	result.Server, _ = config["Server"].(bool)
+
+	// newer agents report the effective settings in DebugConfig, older ones only have the
+	// ACL datacenter set when ACLs are enabled and don't know about Connect at all
+	if enabled, ok := debugConfig["ACLsEnabled"].(bool); ok {
+		result.ACLsEnabled = enabled
+	} else if aclDatacenter, _ := config["ACLDatacenter"].(string); aclDatacenter != "" {
+		result.ACLsEnabled = true
+	}
+	result.ConnectEnabled, _ = debugConfig["ConnectEnabled"].(bool)
+
+	c.agentSelf = result
+	c.agentSelfFetchedAt = time.Now()
+
+	return result, nil
+}
+
 // StartWatchers derp
 func (c *ConsulRegion) StartWatchers() {
 	go c.watchServices()
@@ -124,10 +707,22 @@ func (c *ConsulRegion) watchServices() {
 
 		logger.Debugf("Services index is changed (%d <> %d)", localWaitIndex, remoteWaitIndex)
 
+		// the internal UI endpoint doesn't include tags, add them from the catalog
+		catalog, _, err := c.Client.Catalog().Services(nil)
+		if err != nil {
+			logger.Errorf("watch: unable to fetch service tags: %s", err)
+		} else {
+			for _, service := range services {
+				service.Tags = catalog[service.Name]
+			}
+		}
+
 		c.services = &services
 
-		c.broadcastChannels.services.Update(&Action{Type: fetchedConsulServices, Payload: services, Index: remoteWaitIndex})
-		q = &api.QueryOptions{WaitIndex: remoteWaitIndex}
+		action := &Action{Type: fetchedConsulServices, Payload: services, Index: remoteWaitIndex, Meta: newActionMeta(meta)}
+		c.broadcastChannels.servicesHistory.Add(action)
+		c.broadcastChannels.services.Update(action)
+		q = &api.QueryOptions{WaitIndex: remoteWaitIndex, WaitTime: c.Config.ConsulWaitTime}
 	}
 }
 
@@ -159,7 +754,83 @@ func (c *ConsulRegion) watchNodes() {
 
 		c.nodes = &nodes
 
-		c.broadcastChannels.nodes.Update(&Action{Type: fetchedConsulNodes, Payload: nodes, Index: remoteWaitIndex})
-		q = &api.QueryOptions{WaitIndex: remoteWaitIndex}
+		action := &Action{Type: fetchedConsulNodes, Payload: nodes, Index: remoteWaitIndex, Meta: newActionMeta(meta)}
+		c.broadcastChannels.nodesHistory.Add(action)
+		c.broadcastChannels.nodes.Update(action)
+		q = &api.QueryOptions{WaitIndex: remoteWaitIndex, WaitTime: c.Config.ConsulWaitTime}
 	}
 }
+
+// rawRequest performs a HTTP request against a Consul endpoint that the vendored API client
+// has no support for (non GET/PUT methods, or endpoints newer than the client). The request
+// goes to datacenter, or the region datacenter when empty, and to namespace when set. The
+// endpoint may carry query parameters of its own. The request is aborted when ctx is done.
+func (c *ConsulRegion) rawRequest(ctx context.Context, method, endpoint, datacenter, namespace, token string, in, out interface{}) error {
+	if datacenter == "" {
+		datacenter = c.Datacenter
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+
+	params := u.Query()
+	if datacenter != "" {
+		params.Set("dc", datacenter)
+	}
+
+	if namespace != "" {
+		params.Set("ns", namespace)
+	}
+
+	scheme, transport, err := consulHTTPTransport(c.Config)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: c.Config.ConsulRequestTimeout}
+	if transport != nil {
+		client.Transport = transport
+	}
+
+	u.Scheme, u.Host, u.RawQuery = scheme, c.Config.ConsulAddress, params.Encode()
+
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, u.String(), &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	if token == "" {
+		token = c.Config.ConsulACLToken
+	}
+
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Unexpected response code: %d (%s)", resp.StatusCode, bytes.TrimSpace(message))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConsulContextTransport(t *testing.T) {
+	// a blocking query answering only after its wait time, or when the client goes away
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		name    string
+		path    string
+		aborted bool
+	}{
+		{"blocking query on UNWATCH_ALL", "/v1/catalog/services?index=42&wait=120000ms", true},
+		{"one-shot request on UNWATCH_ALL", "/v1/kv/foo", false},
+	}
+
+	for _, tc := range cases {
+		c := newTestConsulConnection()
+		client := &http.Client{Transport: &consulContextTransport{contextOf: c.requestContext, base: http.DefaultTransport}}
+
+		errs := make(chan error, 1)
+		go func() {
+			resp, err := client.Get(server.URL + tc.path)
+			if err == nil {
+				resp.Body.Close()
+			}
+			errs <- err
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		c.unwatchAll()
+
+		select {
+		case err := <-errs:
+			if !tc.aborted {
+				t.Errorf("%s: request aborted: %v", tc.name, err)
+			} else if err == nil {
+				t.Errorf("%s: request completed instead of being aborted", tc.name)
+			}
+			continue
+		case <-time.After(time.Second):
+			if tc.aborted {
+				t.Errorf("%s: request still running after the watches stopped", tc.name)
+			}
+		}
+
+		// closing the connection aborts whatever is left
+		c.cancel()
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Errorf("%s: request completed instead of being aborted", tc.name)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: request still running after the connection closed", tc.name)
+		}
+	}
+}
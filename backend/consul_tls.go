@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// consulTLSReloadInterval is how often the Consul TLS files are checked for changes
+const consulTLSReloadInterval = 1 * time.Minute
+
+// consulTLSTransport is an http.RoundTripper talking to Consul over TLS, with the CA and client
+// certificate read from files. The files are checked every consulTLSReloadInterval and the
+// transport is rebuilt when they change, so rotated certificates are used without a restart.
+// Requests in flight, like running blocking queries, finish on the previous transport.
+type consulTLSTransport struct {
+	caFile     string
+	certFile   string
+	keyFile    string
+	skipVerify bool
+
+	lock      sync.RWMutex
+	transport *http.Transport
+	modTimes  []time.Time
+
+	stop chan struct{}
+}
+
+// consulHTTP is the HTTP setup shared by everything talking to Consul (the region API clients,
+// raw requests and node agent clients), so they all go through one TLS transport
+var consulHTTP struct {
+	lock      sync.Mutex
+	built     bool
+	scheme    string
+	transport *consulTLSTransport
+}
+
+// consulHTTPTransport returns the scheme and transport to reach Consul with. Without any TLS
+// setting it is plain HTTP and a nil transport, meaning the default one. Otherwise it is HTTPS
+// over the TLS transport, built on the first call.
+func consulHTTPTransport(c *Config) (string, *consulTLSTransport, error) {
+	consulHTTP.lock.Lock()
+	defer consulHTTP.lock.Unlock()
+
+	if consulHTTP.built {
+		return consulHTTP.scheme, consulHTTP.transport, nil
+	}
+
+	if c.ConsulCACert == "" && c.ConsulClientCert == "" && c.ConsulClientKey == "" && !c.ConsulSkipVerify {
+		consulHTTP.built = true
+		consulHTTP.scheme = "http"
+		return consulHTTP.scheme, nil, nil
+	}
+
+	transport, err := newConsulTLSTransport(c.ConsulCACert, c.ConsulClientCert, c.ConsulClientKey, c.ConsulSkipVerify)
+	if err != nil {
+		return "", nil, err
+	}
+
+	consulHTTP.built = true
+	consulHTTP.scheme = "https"
+	consulHTTP.transport = transport
+
+	return consulHTTP.scheme, consulHTTP.transport, nil
+}
+
+// closeConsulHTTP stops watching the TLS files of the shared transport, on shutdown
+func closeConsulHTTP() {
+	consulHTTP.lock.Lock()
+	defer consulHTTP.lock.Unlock()
+
+	if consulHTTP.transport != nil {
+		consulHTTP.transport.Close()
+	}
+}
+
+// newConsulTLSTransport loads the TLS files and starts watching them for changes
+func newConsulTLSTransport(caFile, certFile, keyFile string, skipVerify bool) (*consulTLSTransport, error) {
+	t := &consulTLSTransport{caFile: caFile, certFile: certFile, keyFile: keyFile, skipVerify: skipVerify, stop: make(chan struct{})}
+
+	transport, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+
+	t.transport = transport
+	t.modTimes = t.fileModTimes()
+
+	go t.watch()
+
+	return t, nil
+}
+
+// Close stops watching the TLS files, the current transport keeps working
+func (t *consulTLSTransport) Close() {
+	select {
+	case <-t.stop:
+	default:
+		close(t.stop)
+	}
+}
+
+// RoundTrip sends the request over the current transport
+func (t *consulTLSTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.RLock()
+	transport := t.transport
+	t.lock.RUnlock()
+
+	return transport.RoundTrip(req)
+}
+
+// load builds a transport from the current content of the TLS files
+func (t *consulTLSTransport) load() (*http.Transport, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: t.skipVerify}
+
+	if t.caFile != "" {
+		pem, err := ioutil.ReadFile(t.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the Consul CA cert: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the Consul CA cert %s", t.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if t.certFile != "" || t.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the Consul client cert: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}, nil
+}
+
+// fileModTimes returns the modification times of the TLS files, zero for unset or missing ones
+func (t *consulTLSTransport) fileModTimes() []time.Time {
+	files := []string{t.caFile, t.certFile, t.keyFile}
+	modTimes := make([]time.Time, len(files))
+
+	for i, file := range files {
+		if file == "" {
+			continue
+		}
+
+		if info, err := os.Stat(file); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+
+	return modTimes
+}
+
+// watch rebuilds the transport whenever one of the TLS files changed. A rotation caught halfway
+// (e.g. a new cert with the old key) fails to load and is retried on the next check.
+func (t *consulTLSTransport) watch() {
+	ticker := time.NewTicker(consulTLSReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		modTimes := t.fileModTimes()
+		if equalTimes(modTimes, t.modTimes) {
+			continue
+		}
+
+		transport, err := t.load()
+		if err != nil {
+			logger.Errorf("tls: unable to reload the Consul TLS files, keeping the previous ones: %s", err)
+			continue
+		}
+
+		t.lock.Lock()
+		previous := t.transport
+		t.transport = transport
+		t.lock.Unlock()
+
+		t.modTimes = modTimes
+		previous.CloseIdleConnections()
+
+		logger.Infof("tls: reloaded the Consul TLS files")
+	}
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fieldsLogger logs messages along with key-value fields describing where they come from
+// (connection, region, watch...), rather than interpolating them into the message.
+type fieldsLogger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	// With returns a logger adding the key-value field to the current ones
+	With(key string, value interface{}) fieldsLogger
+}
+
+// logField is a key-value pair attached to every message of a logFmtLogger
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// logFmtLogger is a fieldsLogger appending its fields to the messages in logfmt style
+// (key=value), which log aggregators such as ELK or Loki can parse and index.
+type logFmtLogger struct {
+	fields []logField
+}
+
+// newFieldsLogger creates a fieldsLogger with a first key-value field
+func newFieldsLogger(key string, value interface{}) fieldsLogger {
+	return &logFmtLogger{fields: []logField{{key: key, value: value}}}
+}
+
+func (l *logFmtLogger) With(key string, value interface{}) fieldsLogger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+
+	return &logFmtLogger{fields: append(fields, logField{key: key, value: value})}
+}
+
+// format renders the message followed by the fields, quoting values that would be ambiguous
+func (l *logFmtLogger) format(format string, args []interface{}) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, format, args...)
+
+	for _, field := range l.fields {
+		value := fmt.Sprint(field.value)
+		if value == "" || strings.ContainsAny(value, " =\"") {
+			value = strconv.Quote(value)
+		}
+
+		fmt.Fprintf(&buf, " %s=%s", field.key, value)
+	}
+
+	return buf.String()
+}
+
+func (l *logFmtLogger) Debugf(format string, args ...interface{}) {
+	logger.Debug(l.format(format, args))
+}
+
+func (l *logFmtLogger) Infof(format string, args ...interface{}) {
+	logger.Info(l.format(format, args))
+}
+
+func (l *logFmtLogger) Warningf(format string, args ...interface{}) {
+	logger.Warning(l.format(format, args))
+}
+
+func (l *logFmtLogger) Errorf(format string, args ...interface{}) {
+	logger.Error(l.format(format, args))
+}
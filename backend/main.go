@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -15,8 +19,14 @@ import (
 )
 
 var logger = logging.MustGetLogger("hashi-ui")
+
+// version of hashi-ui, set at build time with -ldflags "-X main.version=..."
+var version = "dev"
 var defaultConfig = DefaultConfig()
 
+// shutdownTimeout is how long websocket connections get to close cleanly on shutdown
+const shutdownTimeout = 10 * time.Second
+
 func startLogging(logLevel string) {
 	logBackend := logging.NewLogBackend(os.Stderr, "", 0)
 
@@ -38,6 +48,31 @@ func startLogging(logLevel string) {
 	logging.SetBackend(logBackendFormattedAndLeveled)
 }
 
+// shutdownOnSignal stops accepting new connections on SIGTERM or SIGINT, then closes the Consul
+// websocket connections cleanly. stopping is closed before the listener, stopped once done.
+func shutdownOnSignal(listener net.Listener, consulHub *ConsulHub, stopping, stopped chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	sig := <-signals
+	logger.Infof("Received %s, shutting down", sig)
+
+	close(stopping)
+	listener.Close()
+
+	if consulHub != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := consulHub.Shutdown(ctx); err != nil {
+			logger.Warningf("Not all Consul connections closed in time: %s", err)
+		}
+		cancel()
+
+		closeConsulHTTP()
+	}
+
+	close(stopped)
+}
+
 // Parse the env and cli flags and store the outcome in a Config struct
 func (c *Config) Parse() {
 	flag.Parse()
@@ -76,9 +111,19 @@ func main() {
 	logger.Infof("-----------------------------------------------------------------------------")
 	logger.Infof("|                             NOMAD UI                                      |")
 	logger.Infof("-----------------------------------------------------------------------------")
+	logger.Infof("| version         	: %-50s |", version)
 	logger.Infof("| listen-address  	: http://%-43s |", cfg.ListenAddress)
 	logger.Infof("| proxy-address   	: %-50s |", cfg.ProxyAddress)
 	logger.Infof("| log-level       	: %-50s |", cfg.LogLevel)
+	logger.Infof("| websocket-compression: %-50t |", cfg.WebsocketCompression)
+	logger.Infof("| websocket-read-limit : %-50d |", cfg.WebsocketReadLimit)
+	logger.Infof("| websocket-gzip-threshold : %-46d |", cfg.WebsocketGzipThreshold)
+	logger.Infof("| websocket-allowed-origins : %-45s |", strings.Join(cfg.WebsocketAllowedOrigins, ","))
+	logger.Infof("| connection-id-length : %-50d |", cfg.ConnectionIDLength)
+	logger.Infof("| connection-id-counter: %-50t |", cfg.ConnectionIDCounter)
+	if !cfg.ConnectionIDCounter {
+		logger.Infof("Connection IDs are likely to collide in the logs after %d connections", likelyConnectionIDCollision(cfg.ConnectionIDLength))
+	}
 
 	if cfg.NewRelicAppName != "" && cfg.NewRelicLicense != "" {
 		logger.Infof("| newrelic-app-name   : %-50s |", cfg.NewRelicAppName)
@@ -111,6 +156,21 @@ func main() {
 		logger.Infof("| consul-read-only     : %-50s |", "No (Hashi-UI can change Consul state)")
 	}
 	logger.Infof("| consul-address       : %-50s |", cfg.ConsulAddress)
+	logger.Infof("| consul-acl-token     : %-50s |", strings.Repeat("*", len(cfg.ConsulACLToken)))
+	logger.Infof("| consul-ca-cert       : %-50s |", cfg.ConsulCACert)
+	logger.Infof("| consul-client-cert   : %-50s |", cfg.ConsulClientCert)
+	logger.Infof("| consul-client-key    : %-50s |", cfg.ConsulClientKey)
+	logger.Infof("| consul-skip-verify   : %-50t |", cfg.ConsulSkipVerify)
+	logger.Infof("| consul-send-buffer   : %-50d |", cfg.ConsulSendBuffer)
+	logger.Infof("| consul-max-watches   : %-50d |", cfg.ConsulMaxWatches)
+	logger.Infof("| consul-wait-time     : %-50s |", cfg.ConsulWaitTime)
+	logger.Infof("| consul-request-timeout: %-49s |", cfg.ConsulRequestTimeout)
+	if cfg.ConsulIdleTimeout > 0 {
+		logger.Infof("| consul-idle-timeout  : %-50s |", cfg.ConsulIdleTimeout)
+	} else {
+		logger.Infof("| consul-idle-timeout  : %-50s |", "Never (idle connections stay open)")
+	}
+	logger.Infof("| consul-replay-buffer : %-50d |", cfg.ConsulReplayBuffer)
 
 	logger.Infof("-----------------------------------------------------------------------------")
 	logger.Infof("")
@@ -119,9 +179,18 @@ func main() {
 		logger.Fatal("Please enable at least Consul (--consul-enable) or Nomad (--nomad-enable)")
 	}
 
+	upgrader.EnableCompression = cfg.WebsocketCompression
+	if len(cfg.WebsocketAllowedOrigins) > 0 {
+		upgrader.CheckOrigin = allowedOriginChecker(cfg.WebsocketAllowedOrigins)
+	} else {
+		logger.Warningf("Websockets are accepted from any origin, set websocket-allowed-origins to protect against cross-site websocket hijacking")
+	}
+
 	myAssetFS := assetFS()
 	router := mux.NewRouter()
 
+	var consulHub *ConsulHub
+
 	if cfg.NomadEnable {
 		nomadHub, nomadSuccess := InitializeNomad(cfg)
 		if !nomadSuccess {
@@ -136,11 +205,12 @@ func main() {
 
 		router.HandleFunc("/ws/nomad", nomadHub.Handler)
 		router.HandleFunc("/ws/nomad/{region}", nomadHub.Handler)
-		router.HandleFunc("/nomad/{region}/download/{path:.*}", nomadHub.downloadFile)
+		router.HandleFunc("/nomad/{region}/download/{path:.*}", authorizedHandler("nomad", downloadNomadFile, nomadHub.downloadFile))
 	}
 
 	if cfg.ConsulEnable {
-		consulHub, consulSuccess := InitializeConsul(cfg)
+		var consulSuccess bool
+		consulHub, consulSuccess = InitializeConsul(cfg)
 		if !consulSuccess {
 			logger.Fatalf("Failed to start Consul hub, please check your configuration")
 		}
@@ -155,6 +225,8 @@ func main() {
 		logger.Infof("Consul client successfully initialized")
 		router.HandleFunc("/ws/consul", consulHub.Handler)
 		router.HandleFunc("/ws/consul/{region}", consulHub.Handler)
+		router.HandleFunc("/consul/{region}/snapshot", authorizedHandler("consul", downloadConsulSnapshot, consulHub.downloadSnapshot))
+		router.HandleFunc("/metrics", authorizedHandler("consul", fetchMetrics, consulHub.metricsHandler))
 	}
 
 	router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -208,9 +280,23 @@ func main() {
 		}
 	})
 
-	logger.Infof("Listening ...")
-	err = http.ListenAndServe(cfg.ListenAddress, router)
+	listener, err := net.Listen("tcp", cfg.ListenAddress)
 	if err != nil {
 		logger.Fatal(err)
 	}
+
+	stopping := make(chan struct{})
+	stopped := make(chan struct{})
+	go shutdownOnSignal(listener, consulHub, stopping, stopped)
+
+	logger.Infof("Listening ...")
+	err = http.Serve(listener, router)
+
+	select {
+	case <-stopping:
+		<-stopped
+		logger.Infof("Shutdown complete")
+	default:
+		logger.Fatal(err)
+	}
 }
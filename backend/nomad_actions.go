@@ -24,6 +24,10 @@ const (
 	watchEval   = "WATCH_EVAL"
 	unwatchEval = "UNWATCH_EVAL"
 
+	watchNomadEvaluation   = "WATCH_NOMAD_EVALUATION"
+	unwatchNomadEvaluation = "UNWATCH_NOMAD_EVALUATION"
+	fetchedNomadEvaluation = "FETCHED_NOMAD_EVALUATION"
+
 	watchJobs   = "WATCH_JOBS"
 	unwatchJobs = "UNWATCH_JOBS"
 	fetchedJobs = "FETCHED_JOBS"
@@ -32,6 +36,10 @@ const (
 	watchJob   = "WATCH_JOB"
 	unwatchJob = "UNWATCH_JOB"
 
+	watchNomadJobAllocSummary   = "WATCH_NOMAD_JOB_ALLOC_SUMMARY"
+	unwatchNomadJobAllocSummary = "UNWATCH_NOMAD_JOB_ALLOC_SUMMARY"
+	fetchedNomadJobAllocSummary = "FETCHED_NOMAD_JOB_ALLOC_SUMMARY"
+
 	watchNodes   = "WATCH_NODES"
 	unwatchNodes = "UNWATCH_NODES"
 	fetchedNodes = "FETCHED_NODES"
@@ -41,6 +49,12 @@ const (
 	watchNode   = "WATCH_NODE"
 	unwatchNode = "UNWATCH_NODE"
 
+	drainNomadNode        = "DRAIN_NOMAD_NODE"
+	drainedNomadNode      = "DRAINED_NOMAD_NODE"
+	watchNomadNodeDrain   = "WATCH_NOMAD_NODE_DRAIN"
+	unwatchNomadNodeDrain = "UNWATCH_NOMAD_NODE_DRAIN"
+	fetchedNomadNodeDrain = "FETCHED_NOMAD_NODE_DRAIN"
+
 	fetchNomadRegions   = "FETCH_NOMAD_REGIONS"
 	fetchedNomadRegions = "FETCHED_NOMAD_REGIONS"
 	unknownNomadRegion  = "UNKNOWN_NOMAD_REGION"
@@ -61,13 +75,32 @@ const (
 	fetchedFile      = "FETCHED_FILE"
 	fileStreamFailed = "FILE_STREAM_FAILED"
 
+	watchNomadAllocLog   = "WATCH_NOMAD_ALLOC_LOG"
+	unwatchNomadAllocLog = "UNWATCH_NOMAD_ALLOC_LOG"
+	fetchedNomadAllocLog = "FETCHED_NOMAD_ALLOC_LOG"
+
+	readNomadAllocFile    = "READ_NOMAD_ALLOC_FILE"
+	fetchedNomadAllocFile = "FETCHED_NOMAD_ALLOC_FILE"
+	listNomadAllocDir     = "LIST_NOMAD_ALLOC_DIR"
+	fetchedNomadAllocDir  = "FETCHED_NOMAD_ALLOC_DIR"
+
 	watchClusterStatistics   = "WATCH_CLUSTER_STATISTICS"
 	fetchedClusterStatistics = "FETCHED_CLUSTER_STATISTICS"
 	unwatchClusterStatistics = "UNWATCH_CLUSTER_STATISTICS"
 
 	changeTaskGroupCount = "CHANGE_TASK_GROUP_COUNT"
 	submitJob            = "SUBMIT_JOB"
+	submittedJob         = "SUBMITTED_JOB"
+	planJob              = "PLAN_JOB"
+	fetchedJobPlan       = "FETCHED_JOB_PLAN"
 	stopJob              = "STOP_JOB"
+	stoppedJob           = "STOPPED_JOB"
+	scaleJob             = "SCALE_JOB"
+	scaledJob            = "SCALED_JOB"
+
+	evaluateJob  = "EVALUATE_JOB"
+	evaluatedJob = "EVALUATED_JOB"
 
-	evaluateJob = "EVALUATE_JOB"
+	forceNomadPeriodicJob  = "FORCE_NOMAD_PERIODIC_JOB"
+	forcedNomadPeriodicJob = "FORCED_NOMAD_PERIODIC_JOB"
 )
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"time"
+	"unicode/utf8"
 
 	"gopkg.in/fatih/set.v0"
 
@@ -29,6 +32,10 @@ const (
 	// If a file exceeds an estimate of 250 loglines we start tailing it
 	// from the end, otherwise the whole file is retrieved and followed.
 	maxFileSize int64 = defaultTailLines * bytesToLines
+
+	// maxAllocFileRead is the largest chunk of a file READ_NOMAD_ALLOC_FILE sends at once,
+	// bigger files are paged through with the offset
+	maxAllocFileRead int64 = 512 * 1024
 )
 
 // NomadConnection monitors the websocket connection. It processes any action
@@ -37,6 +44,7 @@ const (
 type NomadConnection struct {
 	ID                uuid.UUID
 	shortID           string
+	log               fieldsLogger
 	socket            *websocket.Conn
 	receive           chan *Action
 	send              chan *Action
@@ -50,10 +58,12 @@ type NomadConnection struct {
 // NewNomadConnection creates a new connection.
 func NewNomadConnection(hub *NomadHub, socket *websocket.Conn, nomadRegion *NomadRegion, channels *NomadRegionBroadcastChannels) *NomadConnection {
 	connectionID := uuid.NewV4()
+	shortID := newShortID(connectionID, nomadRegion.Config)
 
 	return &NomadConnection{
 		ID:                connectionID,
-		shortID:           fmt.Sprintf("%s", connectionID)[0:8],
+		shortID:           shortID,
+		log:               newFieldsLogger("connection", shortID),
 		watches:           set.New(),
 		hub:               hub,
 		socket:            socket,
@@ -65,32 +75,35 @@ func NewNomadConnection(hub *NomadHub, socket *websocket.Conn, nomadRegion *Noma
 	}
 }
 
-// Warningf is a stupid wrapper for logger.Warningf
+// Warningf is a stupid wrapper for logger.Warningf, adding the connection fields
 func (c *NomadConnection) Warningf(format string, args ...interface{}) {
-	message := fmt.Sprintf("[%s] ", c.shortID) + format
-	logger.Warningf(message, args...)
+	c.log.Warningf(format, args...)
 }
 
-// Errorf is a stupid wrapper for logger.Errorf
+// Errorf is a stupid wrapper for logger.Errorf, adding the connection fields
 func (c *NomadConnection) Errorf(format string, args ...interface{}) {
-	message := fmt.Sprintf("[%s] ", c.shortID) + format
-	logger.Errorf(message, args...)
+	c.log.Errorf(format, args...)
 }
 
-// Infof is a stupid wrapper for logger.Infof
+// Infof is a stupid wrapper for logger.Infof, adding the connection fields
 func (c *NomadConnection) Infof(format string, args ...interface{}) {
-	message := fmt.Sprintf("[%s] ", c.shortID) + format
-	logger.Infof(message, args...)
+	c.log.Infof(format, args...)
 }
 
-// Debugf is a stupid wrapper for logger.Debugf
+// Debugf is a stupid wrapper for logger.Debugf, adding the connection fields
 func (c *NomadConnection) Debugf(format string, args ...interface{}) {
-	message := fmt.Sprintf("[%s] ", c.shortID) + format
-	logger.Debugf(message, args...)
+	c.log.Debugf(format, args...)
 }
 
+// writePump writes the queued actions and pings to the socket. Every write has to complete
+// within writeWait, a failed write closes the socket so readPump tears the connection down.
+// The pump itself keeps running until Handle signals destroyCh.
 func (c *NomadConnection) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	var seq uint64
+
 	defer func() {
+		ticker.Stop()
 		c.socket.Close()
 	}()
 
@@ -99,21 +112,37 @@ func (c *NomadConnection) writePump() {
 		case <-c.destroyCh:
 			c.Warningf("Stopping writePump")
 			return
+		case <-ticker.C:
+			c.socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.socket.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				c.Errorf("Could not write ping message to websocket: %s", err)
+				c.socket.Close()
+			}
 		case action, ok := <-c.send:
 			if !ok {
+				c.socket.SetWriteDeadline(time.Now().Add(writeWait))
 				if err := c.socket.WriteMessage(websocket.CloseMessage, []byte{}); err != nil {
 					c.Errorf("Could not write close message to websocket: %s", err)
 				}
 				return
 			}
 
-			if err := c.socket.WriteJSON(action); err != nil {
+			c.socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.socket.WriteJSON(sequenceFrame(batchActions(action, c.send), &seq)); err != nil {
 				c.Errorf("Could not write action to websocket: %s", err)
+				c.socket.Close()
 			}
 		}
 	}
 }
 
+// reply sends response to the write action request, echoing its request ID so the client can
+// tell which of its writes the notification answers
+func (c *NomadConnection) reply(request Action, response *Action) {
+	response.RequestID = request.RequestID
+	c.send <- response
+}
+
 func (c *NomadConnection) readPump() {
 	defer func() {
 		c.watches.Clear()
@@ -124,13 +153,34 @@ func (c *NomadConnection) readPump() {
 	// Register this connection with the hub for broadcast updates
 	c.hub.register <- c
 
-	var action Action
+	// Oversized messages fail the read, which tears down the connection
+	c.socket.SetReadLimit(c.region.Config.WebsocketReadLimit)
+
+	// Tear down the connection if the client stops answering our pings
+	c.socket.SetReadDeadline(time.Now().Add(pongWait))
+	c.socket.SetPongHandler(func(string) error {
+		c.socket.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
 	for {
-		err := c.socket.ReadJSON(&action)
+		// only failing to read a message ends the connection, a message that isn't a valid
+		// action is reported to the client and skipped
+		_, message, err := c.socket.ReadMessage()
 		if err != nil {
 			break
 		}
 
+		// a fresh action for every message, fields it doesn't set (RequestID) mustn't
+		// carry over from the previous one
+		var action Action
+		if err := json.Unmarshal(message, &action); err != nil {
+			c.Warningf("Ignoring a malformed message: %s", err)
+			r := rand.New(rand.NewSource(time.Now().UnixNano()))
+			c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Ignoring a malformed message: %s", err), Index: uint64(r.Int())}
+			continue
+		}
+
 		c.process(action)
 	}
 }
@@ -138,6 +188,14 @@ func (c *NomadConnection) readPump() {
 func (c *NomadConnection) process(action Action) {
 	c.Debugf("Processing event %s (index %d)", action.Type, action.Index)
 
+	identity := ConnectionIdentity{Backend: "nomad", ConnectionID: c.shortID, RemoteAddr: c.socket.RemoteAddr().String()}
+	if err := authorizeAction(identity, action.Type); err != nil {
+		c.Warningf("Denied %s: %s", action.Type, err)
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		c.reply(action, &Action{Type: errorNotification, Payload: deniedActionMessage(action.Type, err), Index: uint64(r.Int())})
+		return
+	}
+
 	switch action.Type {
 	//
 	// Actions for a list of members (aka servers in the UI)
@@ -200,6 +258,12 @@ func (c *NomadConnection) process(action Action) {
 		c.watches.Remove(action.Payload.(string))
 	case fetchNode:
 		go c.fetchNode(action)
+	case drainNomadNode:
+		go c.drainNode(action)
+	case watchNomadNodeDrain:
+		go c.watchNodeDrain(action)
+	case unwatchNomadNodeDrain:
+		c.watches.Remove("node/drain/" + action.Payload.(string))
 
 	//
 	// Actions for a single job
@@ -208,6 +272,10 @@ func (c *NomadConnection) process(action Action) {
 		go c.watchJob(action)
 	case unwatchJob:
 		c.watches.Remove(action.Payload.(string))
+	case watchNomadJobAllocSummary:
+		go c.watchJobAllocSummary(action)
+	case unwatchNomadJobAllocSummary:
+		c.watches.Remove("job/allocs/summary/" + action.Payload.(string))
 
 	//
 	// Actions for a single allocation
@@ -226,6 +294,16 @@ func (c *NomadConnection) process(action Action) {
 		go c.watchFile(action)
 	case unwatchFile: // for stopping a follow of a file (tail -f)
 		c.watches.Remove(action.Payload.(string))
+	case watchNomadAllocLog: // for streaming the stdout/stderr of a task
+		go c.watchAllocLog(action)
+	case unwatchNomadAllocLog:
+		if key, ok := allocLogWatchKey(action.Payload); ok {
+			c.watches.Remove(key)
+		}
+	case readNomadAllocFile: // for paging through a file of an allocation
+		go c.readAllocFile(action)
+	case listNomadAllocDir:
+		go c.listAllocDir(action)
 
 	case fetchClientStats:
 		go c.fetchClientStats(action)
@@ -249,6 +327,10 @@ func (c *NomadConnection) process(action Action) {
 		go c.watchEval(action)
 	case unwatchEval:
 		c.watches.Remove(action.Payload.(string))
+	case watchNomadEvaluation:
+		go c.watchEvaluation(action)
+	case unwatchNomadEvaluation:
+		c.watches.Remove("evaluation/" + action.Payload.(string))
 
 	// Change task group count
 	case changeTaskGroupCount:
@@ -258,16 +340,28 @@ func (c *NomadConnection) process(action Action) {
 	case submitJob:
 		go c.submitJob(action)
 
+	// Dry run a job submission
+	case planJob:
+		go c.planJob(action)
+
 	// Stop a job
 	case stopJob:
 		go c.stopJob(action)
 
+	// Set the count of a task group
+	case scaleJob:
+		go c.scaleJob(action)
+
 	case fetchNomadRegions:
 		go c.fetchRegions()
 
 	case evaluateJob:
 		go c.evaluateJob(action)
 
+	// Run a periodic job now, regardless of its schedule
+	case forceNomadPeriodicJob:
+		go c.forcePeriodicJob(action)
+
 	// Nice in debug
 	default:
 		logger.Errorf("Unknown action: %s", action.Type)
@@ -277,7 +371,6 @@ func (c *NomadConnection) process(action Action) {
 // Handle monitors the websocket connection for incoming actions. It sends
 // out actions on state changes.
 func (c *NomadConnection) Handle() {
-	go c.keepAlive()
 	go c.writePump()
 	c.readPump()
 
@@ -289,21 +382,6 @@ func (c *NomadConnection) Handle() {
 	close(c.destroyCh)
 }
 
-func (c *NomadConnection) keepAlive() {
-	logger.Debugf("Starting keep-alive packer sender")
-	ticker := time.NewTicker(10 * time.Second)
-
-	for {
-		select {
-		case <-c.destroyCh:
-			return
-		case <-ticker.C:
-			logger.Debugf("Sending keep-alive packet")
-			c.socket.WriteMessage(websocket.PingMessage, []byte("keepalive"))
-		}
-	}
-}
-
 func (c *NomadConnection) watchAlloc(action Action) {
 	allocID := action.Payload.(string)
 
@@ -386,6 +464,91 @@ func (c *NomadConnection) watchEval(action Action) {
 	}
 }
 
+// maxBlockedEvalChain bounds how many blocked evaluations watchEvaluation follows
+const maxBlockedEvalChain = 10
+
+// NomadEvaluation is an evaluation along with the allocations it placed, and the chain of
+// blocked evaluations created for the task groups it failed to place (see FailedTGAllocs)
+type NomadEvaluation struct {
+	Evaluation   *api.Evaluation
+	Allocations  []*api.AllocationListStub
+	BlockedEvals []*api.Evaluation
+}
+
+func (c *NomadConnection) watchEvaluation(action Action) {
+	evalID := action.Payload.(string)
+	key := "evaluation/" + evalID
+
+	defer func() {
+		c.watches.Remove(key)
+		c.Infof("Stopped watching %s", key)
+	}()
+	c.watches.Add(key)
+
+	c.Infof("Started watching %s", key)
+
+	q := &api.QueryOptions{WaitIndex: 1}
+	for {
+		select {
+		case <-c.destroyCh:
+			return
+		default:
+			eval, meta, err := c.region.Client.Evaluations().Info(evalID, q)
+			if err != nil {
+				c.Errorf("connection: unable to fetch eval info: %s", err)
+				time.Sleep(10 * time.Second)
+				continue
+			}
+
+			allocs, _, err := c.region.Client.Evaluations().Allocations(evalID, nil)
+			if err != nil {
+				c.Errorf("connection: unable to fetch eval allocations: %s", err)
+				time.Sleep(10 * time.Second)
+				continue
+			}
+
+			if !c.watches.Has(key) {
+				return
+			}
+
+			remoteWaitIndex := meta.LastIndex
+			localWaitIndex := q.WaitIndex
+
+			// only broadcast if the LastIndex has changed
+			if remoteWaitIndex > localWaitIndex {
+				c.send <- &Action{
+					Type: fetchedNomadEvaluation,
+					Payload: &NomadEvaluation{
+						Evaluation:   eval,
+						Allocations:  allocs,
+						BlockedEvals: c.blockedEvalChain(eval),
+					},
+					Index: remoteWaitIndex,
+				}
+				q = &api.QueryOptions{WaitIndex: remoteWaitIndex, WaitTime: 10 * time.Second}
+			}
+		}
+	}
+}
+
+// blockedEvalChain follows the BlockedEval links of eval, a blocked evaluation being itself
+// able to create another one when it fails to place everything once unblocked
+func (c *NomadConnection) blockedEvalChain(eval *api.Evaluation) []*api.Evaluation {
+	chain := make([]*api.Evaluation, 0)
+	for next := eval.BlockedEval; next != "" && len(chain) < maxBlockedEvalChain; {
+		blocked, _, err := c.region.Client.Evaluations().Info(next, nil)
+		if err != nil {
+			c.Warningf("connection: unable to fetch blocked eval %s: %s", next, err)
+			break
+		}
+
+		chain = append(chain, blocked)
+		next = blocked.BlockedEval
+	}
+
+	return chain
+}
+
 func (c *NomadConnection) fetchMember(action Action) {
 	memberID := action.Payload.(string)
 	member, err := c.hub.cluster.MemberWithID(memberID)
@@ -483,6 +646,140 @@ func (c *NomadConnection) watchNode(action Action) {
 	}
 }
 
+// drainNode enables or cancels (enable false) the drain of a client node. The Nomad version
+// hashi-ui is built against drains nodes right away, so drain deadlines and keeping system jobs
+// running are refused rather than silently ignored.
+func (c *NomadConnection) drainNode(action Action) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	index := uint64(r.Int())
+
+	if c.region.Config.NomadReadOnly {
+		logger.Errorf("Unable to drain node: NomadReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "The backend server is in read-only mode", Index: index})
+		return
+	}
+
+	params, ok := action.Payload.(map[string]interface{})
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	nodeID, _ := params["nodeID"].(string)
+	enable, _ := params["enable"].(bool)
+
+	if nodeID == "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to drain node - missing node ID", Index: index})
+		return
+	}
+
+	_, hasDeadline := params["deadline"]
+	_, hasIgnoreSystemJobs := params["ignoreSystemJobs"]
+	if hasDeadline || hasIgnoreSystemJobs {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Drain deadlines and ignoring system jobs require Nomad 0.8 or newer", Index: index})
+		return
+	}
+
+	meta, err := c.region.Client.Nodes().ToggleDrain(nodeID, enable, nil)
+	if err != nil {
+		logger.Errorf("connection: unable to toggle drain of node '%s' : %s", nodeID, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to toggle drain of node : %s", err), Index: index})
+		return
+	}
+
+	// the vendored client drops the evaluations created by the drain, only the index of the
+	// update is known. WATCH_NOMAD_NODE_DRAIN follows the allocations being migrated.
+	c.reply(action, &Action{Type: drainedNomadNode, Payload: struct {
+		NodeID string
+		Enable bool
+		Index  uint64
+	}{
+		NodeID: nodeID,
+		Enable: enable,
+		Index:  meta.LastIndex,
+	}, Index: index})
+
+	if enable {
+		c.reply(action, &Action{Type: successNotification, Payload: "The node is now draining.", Index: index})
+	} else {
+		c.reply(action, &Action{Type: successNotification, Payload: "The node drain has been cancelled.", Index: index})
+	}
+}
+
+// watchNodeDrain streams the drain progress of a client node: whether it is draining, and the
+// allocations still pending or running on it
+func (c *NomadConnection) watchNodeDrain(action Action) {
+	nodeID := action.Payload.(string)
+	key := "node/drain/" + nodeID
+
+	defer func() {
+		c.watches.Remove(key)
+		c.Infof("Stopped watching %s", key)
+	}()
+	c.watches.Add(key)
+
+	c.Infof("Started watching %s", key)
+
+	q := &api.QueryOptions{WaitIndex: 1}
+	var lastDrain bool
+	for {
+		select {
+		case <-c.destroyCh:
+			return
+
+		default:
+			allocs, meta, err := c.region.Client.Nodes().Allocations(nodeID, q)
+			if err != nil {
+				c.Errorf("connection: unable to fetch node allocations: %s", err)
+				time.Sleep(10 * time.Second)
+				continue
+			}
+
+			node, _, err := c.region.Client.Nodes().Info(nodeID, nil)
+			if err != nil {
+				c.Errorf("connection: unable to fetch node info: %s", err)
+				time.Sleep(10 * time.Second)
+				continue
+			}
+
+			if !c.watches.Has(key) {
+				return
+			}
+
+			remoteWaitIndex := meta.LastIndex
+			localWaitIndex := q.WaitIndex
+
+			// only broadcast if the LastIndex has changed, or the drain was toggled (which only
+			// changes the node, not its allocations)
+			if remoteWaitIndex > localWaitIndex || node.Drain != lastDrain {
+				lastDrain = node.Drain
+
+				remaining := make([]*api.Allocation, 0)
+				for _, alloc := range allocs {
+					if alloc.ClientStatus == "pending" || alloc.ClientStatus == "running" {
+						remaining = append(remaining, alloc)
+					}
+				}
+
+				c.send <- &Action{
+					Type: fetchedNomadNodeDrain,
+					Payload: struct {
+						NodeID    string
+						Drain     bool
+						Remaining []*api.Allocation
+					}{
+						NodeID:    nodeID,
+						Drain:     node.Drain,
+						Remaining: remaining,
+					},
+					Index: remoteWaitIndex,
+				}
+				q = &api.QueryOptions{WaitIndex: remoteWaitIndex, WaitTime: 10 * time.Second}
+			}
+		}
+	}
+}
+
 func (c *NomadConnection) watchGenericBroadcast(watchKey string, actionEvent string, prop observer.Property, initialPayload interface{}) {
 	defer func() {
 		c.watches.Remove(watchKey)
@@ -577,6 +874,75 @@ func (c *NomadConnection) watchJob(action Action) {
 	}
 }
 
+// NomadJobAllocSummary counts the allocations of a job by client status
+type NomadJobAllocSummary struct {
+	JobID    string
+	Running  int
+	Pending  int
+	Failed   int
+	Complete int
+	Lost     int
+	Total    int
+}
+
+func (c *NomadConnection) watchJobAllocSummary(action Action) {
+	jobID := action.Payload.(string)
+	key := "job/allocs/summary/" + jobID
+
+	defer func() {
+		c.watches.Remove(key)
+		c.Infof("Stopped watching %s", key)
+	}()
+	c.watches.Add(key)
+
+	c.Infof("Started watching %s", key)
+
+	q := &api.QueryOptions{WaitIndex: 1}
+	for {
+		select {
+		case <-c.destroyCh:
+			return
+
+		default:
+			allocs, meta, err := c.region.Client.Jobs().Allocations(jobID, q)
+			if err != nil {
+				c.Errorf("connection: unable to fetch job allocations: %s", err)
+				time.Sleep(10 * time.Second)
+				continue
+			}
+
+			if !c.watches.Has(key) {
+				return
+			}
+
+			remoteWaitIndex := meta.LastIndex
+			localWaitIndex := q.WaitIndex
+
+			// only broadcast if the LastIndex has changed
+			if remoteWaitIndex > localWaitIndex {
+				summary := &NomadJobAllocSummary{JobID: jobID, Total: len(allocs)}
+				for _, alloc := range allocs {
+					switch alloc.ClientStatus {
+					case "running":
+						summary.Running++
+					case "pending":
+						summary.Pending++
+					case "failed":
+						summary.Failed++
+					case "complete":
+						summary.Complete++
+					case "lost":
+						summary.Lost++
+					}
+				}
+
+				c.send <- &Action{Type: fetchedNomadJobAllocSummary, Payload: summary, Index: remoteWaitIndex}
+				q = &api.QueryOptions{WaitIndex: remoteWaitIndex, WaitTime: 10 * time.Second}
+			}
+		}
+	}
+}
+
 func (c *NomadConnection) fetchClientStats(action Action) {
 	nodeID, ok := action.Payload.(string)
 	if !ok {
@@ -809,6 +1175,321 @@ func (c *NomadConnection) watchFile(action Action) {
 	}
 }
 
+// allocLogWatchKey identifies the log stream of a task from a (un)watch alloc log payload
+func allocLogWatchKey(payload interface{}) (string, bool) {
+	params, ok := payload.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+
+	allocID, _ := params["allocID"].(string)
+	task, _ := params["task"].(string)
+	logType, _ := params["type"].(string)
+
+	if allocID == "" || task == "" {
+		return "", false
+	}
+
+	if logType == "" {
+		logType = "stdout"
+	}
+
+	return fmt.Sprintf("alloc/logs/%s/%s/%s", allocID, task, logType), true
+}
+
+// watchAllocLog streams the stdout or stderr log of a task in an allocation. The log is read
+// from offset bytes after the start (or before the end when origin is "end"), and keeps
+// streaming new output when follow is set.
+func (c *NomadConnection) watchAllocLog(action Action) {
+	key, ok := allocLogWatchKey(action.Payload)
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	params := action.Payload.(map[string]interface{})
+	allocID := params["allocID"].(string)
+	task := params["task"].(string)
+	logType, _ := params["type"].(string)
+	follow, _ := params["follow"].(bool)
+	origin, _ := params["origin"].(string)
+
+	var offset int64
+	if val, ok := params["offset"].(float64); ok {
+		offset = int64(val)
+	}
+
+	if logType == "" {
+		logType = "stdout"
+	}
+
+	if logType != "stdout" && logType != "stderr" {
+		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Invalid log type: %s", logType), Index: 0}
+		return
+	}
+
+	if origin != api.OriginEnd {
+		origin = api.OriginStart
+	}
+
+	if c.watches.Has(key) {
+		c.Warningf("Connection is already subscribed to %s", key)
+		return
+	}
+
+	alloc, _, err := c.region.Client.Allocations().Info(allocID, nil)
+	if err != nil {
+		c.Errorf("Unable to fetch alloc: %s", err)
+		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Could not find allocation: %s", allocID), Index: 0}
+		return
+	}
+
+	cancel := make(chan struct{})
+	frames, err := c.region.Client.AllocFS().Logs(alloc, follow, task, logType, origin, offset, cancel, nil)
+	if err != nil {
+		c.Errorf("Unable to stream logs: %s", err)
+		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to stream the %s of %s: %s", logType, task, err), Index: 0}
+		return
+	}
+
+	c.watches.Add(key)
+
+	defer func() {
+		c.Infof("Stopped watching %s", key)
+		c.watches.Remove(key)
+		close(cancel)
+	}()
+
+	c.Infof("Started watching %s", key)
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+
+		case <-c.destroyCh:
+			return
+
+		case frame, ok := <-frames:
+			// without follow the stream ends with the log
+			if !ok {
+				return
+			}
+
+			if !c.watches.Has(key) {
+				return
+			}
+
+			if frame.IsHeartbeat() || len(frame.Data) == 0 {
+				continue
+			}
+
+			c.send <- &Action{
+				Type: fetchedNomadAllocLog,
+				Payload: struct {
+					AllocID string
+					Task    string
+					Type    string
+					File    string
+					Offset  int64
+					Data    string
+				}{
+					AllocID: allocID,
+					Task:    task,
+					Type:    logType,
+					File:    frame.File,
+					Offset:  frame.Offset,
+					Data:    string(frame.Data),
+				},
+				Index: 0,
+			}
+
+		case <-ticker.C:
+			if !c.watches.Has(key) {
+				return
+			}
+		}
+	}
+}
+
+// NomadAllocFile is a chunk of a file of an allocation, read from Offset, the next one starts at
+// NextOffset. Data is the plain content of text files, and base64 encoded (Base64 set) for
+// anything that isn't valid UTF-8.
+type NomadAllocFile struct {
+	AllocID    string
+	Path       string
+	Offset     int64
+	NextOffset int64
+	Size       int64
+	Data       string
+	Base64     bool
+	EOF        bool
+}
+
+// readAllocFile sends a chunk of a file of an allocation, of at most limit (and
+// maxAllocFileRead) bytes from offset. Unlike WATCH_FILE it reads through the region client,
+// and doesn't follow the file.
+func (c *NomadConnection) readAllocFile(action Action) {
+	params, ok := action.Payload.(map[string]interface{})
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	allocID, _ := params["allocID"].(string)
+	path, _ := params["path"].(string)
+
+	var offset int64
+	if val, ok := params["offset"].(float64); ok && val > 0 {
+		offset = int64(val)
+	}
+
+	limit := maxAllocFileRead
+	if val, ok := params["limit"].(float64); ok && val > 0 && int64(val) < limit {
+		limit = int64(val)
+	}
+
+	if allocID == "" || path == "" {
+		c.send <- &Action{Type: errorNotification, Payload: "Unable to read file - missing allocation ID or path", Index: 0}
+		return
+	}
+
+	alloc, _, err := c.region.Client.Allocations().Info(allocID, nil)
+	if err != nil {
+		c.Errorf("Unable to fetch alloc: %s", err)
+		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Could not find allocation: %s", allocID), Index: 0}
+		return
+	}
+
+	file, _, err := c.region.Client.AllocFS().Stat(alloc, path, nil)
+	if err != nil {
+		c.Errorf("Unable to stat file: %s", err)
+		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to read %s: %s", path, err), Index: 0}
+		return
+	}
+
+	if file.IsDir {
+		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to read %s: it is a directory", path), Index: 0}
+		return
+	}
+
+	result := &NomadAllocFile{AllocID: allocID, Path: path, Offset: offset, Size: file.Size}
+
+	if offset < file.Size {
+		if offset+limit > file.Size {
+			limit = file.Size - offset
+		}
+
+		r, err := c.region.Client.AllocFS().ReadAt(alloc, path, offset, limit, nil)
+		if err != nil {
+			c.Errorf("Unable to read file: %s", err)
+			c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to read %s: %s", path, err), Index: 0}
+			return
+		}
+
+		// closing the reader aborts the read if the connection goes away meanwhile
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-c.destroyCh:
+				r.Close()
+			case <-done:
+			}
+		}()
+
+		data, err := ioutil.ReadAll(io.LimitReader(r, limit))
+		close(done)
+		r.Close()
+
+		if err != nil {
+			c.Errorf("Unable to read file: %s", err)
+			c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to read %s: %s", path, err), Index: 0}
+			return
+		}
+
+		// a chunk ending in the middle of a multi-byte character is cut back to its start, so the
+		// pages of a text file are all plain text and concatenate back to the file
+		if cut := incompleteRuneSuffix(data); cut > 0 && cut < len(data) && utf8.Valid(data[:len(data)-cut]) {
+			data = data[:len(data)-cut]
+		}
+
+		if utf8.Valid(data) {
+			result.Data = string(data)
+		} else {
+			result.Data = base64.StdEncoding.EncodeToString(data)
+			result.Base64 = true
+		}
+
+		offset += int64(len(data))
+	}
+
+	result.NextOffset = offset
+	result.EOF = offset >= file.Size
+
+	c.send <- &Action{Type: fetchedNomadAllocFile, Payload: result, Index: 0}
+}
+
+// incompleteRuneSuffix returns the length of the UTF-8 character data ends in the middle of,
+// 0 when its last character is complete
+func incompleteRuneSuffix(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-(utf8.UTFMax-1); i-- {
+		if utf8.RuneStart(data[i]) {
+			if utf8.FullRune(data[i:]) {
+				return 0
+			}
+
+			return len(data) - i
+		}
+	}
+
+	return 0
+}
+
+// listAllocDir sends the files of a directory of an allocation, through the region client
+func (c *NomadConnection) listAllocDir(action Action) {
+	params, ok := action.Payload.(map[string]interface{})
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	allocID, _ := params["allocID"].(string)
+	path, _ := params["path"].(string)
+
+	if path == "" {
+		path = "/"
+	}
+
+	alloc, _, err := c.region.Client.Allocations().Info(allocID, nil)
+	if err != nil {
+		c.Errorf("Unable to fetch alloc: %s", err)
+		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Could not find allocation: %s", allocID), Index: 0}
+		return
+	}
+
+	files, _, err := c.region.Client.AllocFS().List(alloc, path, nil)
+	if err != nil {
+		c.Errorf("Unable to fetch directory: %s", err)
+		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to list %s: %s", path, err), Index: 0}
+		return
+	}
+
+	c.send <- &Action{
+		Type: fetchedNomadAllocDir,
+		Payload: struct {
+			AllocID string
+			Path    string
+			Files   []*api.AllocFileInfo
+		}{
+			AllocID: allocID,
+			Path:    path,
+			Files:   files,
+		},
+		Index: 0,
+	}
+}
+
 func (c *NomadConnection) changeTaskGroupCount(action Action) {
 	params, ok := action.Payload.(map[string]interface{})
 	if !ok {
@@ -885,25 +1566,82 @@ func (c *NomadConnection) submitJob(action Action) {
 
 	if c.region.Config.NomadReadOnly {
 		logger.Errorf("Unable to submit job: NomadReadOnly is set to true")
-		c.send <- &Action{Type: errorNotification, Payload: "The backend server is in read-only mode", Index: index}
+		c.reply(action, &Action{Type: errorNotification, Payload: "The backend server is in read-only mode", Index: index})
 		return
 	}
 
-	jobjson := action.Payload.(string)
-	runjob := api.Job{}
-	json.Unmarshal([]byte(jobjson), &runjob)
+	runjob, err := decodeJob(action.Payload)
+	if err != nil {
+		logger.Errorf("connection: invalid job submitted: %s", err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Invalid job : %s", err), Index: index})
+		return
+	}
 
 	logger.Infof("Started submission of job with id: %s", runjob.ID)
 
-	_, _, err := c.region.Client.Jobs().Register(&runjob, nil)
+	evalID, _, err := c.region.Client.Jobs().Register(runjob, nil)
 	if err != nil {
 		logger.Errorf("connection: unable to submit job '%s' : %s", runjob.ID, err)
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to submit job : %s", err), Index: index}
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to submit job : %s", err), Index: index})
 		return
 	}
 
 	logger.Infof("connection: successfully submit job '%s'", runjob.ID)
-	c.send <- &Action{Type: successNotification, Payload: "The job has been successfully updated.", Index: index}
+	c.reply(action, &Action{Type: submittedJob, Payload: struct {
+		JobID  string
+		EvalID string
+	}{
+		JobID:  runjob.ID,
+		EvalID: evalID,
+	}, Index: index})
+	c.reply(action, &Action{Type: successNotification, Payload: "The job has been successfully updated.", Index: index})
+}
+
+// planJob dry runs the submission of a job, and sends the plan with the diff against the
+// current version of the job. Planning doesn't change any state, so it is allowed in read-only mode.
+func (c *NomadConnection) planJob(action Action) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	index := uint64(r.Int())
+
+	runjob, err := decodeJob(action.Payload)
+	if err != nil {
+		logger.Errorf("connection: invalid job planned: %s", err)
+		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Invalid job : %s", err), Index: index}
+		return
+	}
+
+	plan, _, err := c.region.Client.Jobs().Plan(runjob, true, nil)
+	if err != nil {
+		logger.Errorf("connection: unable to plan job '%s' : %s", runjob.ID, err)
+		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to plan job : %s", err), Index: index}
+		return
+	}
+
+	c.send <- &Action{Type: fetchedJobPlan, Payload: plan, Index: index}
+}
+
+// decodeJob decodes a job submitted as JSON, and checks the fields Nomad can't do without.
+// Everything else is validated by Nomad, whose errors are passed on to the client.
+func decodeJob(payload interface{}) (*api.Job, error) {
+	jobjson, ok := payload.(string)
+	if !ok {
+		return nil, fmt.Errorf("the job must be submitted as a JSON string")
+	}
+
+	job := &api.Job{}
+	if err := json.Unmarshal([]byte(jobjson), job); err != nil {
+		return nil, fmt.Errorf("unable to parse the job: %s", err)
+	}
+
+	if job.ID == "" {
+		return nil, fmt.Errorf("missing job ID")
+	}
+
+	if len(job.TaskGroups) == 0 {
+		return nil, fmt.Errorf("job %s has no task groups", job.ID)
+	}
+
+	return job, nil
 }
 
 func (c *NomadConnection) stopJob(action Action) {
@@ -912,23 +1650,123 @@ func (c *NomadConnection) stopJob(action Action) {
 
 	if c.region.Config.NomadReadOnly {
 		logger.Errorf("Unable to stop job: NomadReadOnly is set to true")
-		c.send <- &Action{Type: errorNotification, Payload: "The backend server is in read-only mode", Index: index}
+		c.reply(action, &Action{Type: errorNotification, Payload: "The backend server is in read-only mode", Index: index})
 		return
 	}
 
-	jobID := action.Payload.(string)
+	// the payload is either the job ID, or an object with the job ID and the purge flag
+	var jobID string
+	var purge bool
+	switch payload := action.Payload.(type) {
+	case string:
+		jobID = payload
+	case map[string]interface{}:
+		jobID, _ = payload["jobID"].(string)
+		purge, _ = payload["purge"].(bool)
+	}
+
+	if jobID == "" {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to stop job - missing job ID", Index: index})
+		return
+	}
+
+	// the Nomad version hashi-ui is built against keeps stopped jobs until they are garbage
+	// collected, refuse rather than leaving the job around while the client expects it gone
+	if purge {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Purging stopped jobs requires Nomad 0.6 or newer", Index: index})
+		return
+	}
 
 	logger.Infof("Begin stop of job with id: %s", jobID)
 
-	_, _, err := c.region.Client.Jobs().Deregister(jobID, nil)
+	evalID, _, err := c.region.Client.Jobs().Deregister(jobID, nil)
 	if err != nil {
 		logger.Errorf("connection: unable to stop job '%s' : %s", jobID, err)
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to stop job : %s", err), Index: index}
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to stop job : %s", err), Index: index})
 		return
 	}
 
 	logger.Infof("connection: successfully stopped job '%s'", jobID)
-	c.send <- &Action{Type: successNotification, Payload: "The job has been successfully stopped.", Index: index}
+	c.reply(action, &Action{Type: stoppedJob, Payload: struct {
+		JobID  string
+		EvalID string
+	}{
+		JobID:  jobID,
+		EvalID: evalID,
+	}, Index: index})
+	c.reply(action, &Action{Type: successNotification, Payload: "The job has been successfully stopped.", Index: index})
+}
+
+// scaleJob sets the count of a task group, and sends the evaluation of the updated job.
+// Unlike CHANGE_TASK_GROUP_COUNT the count is given, rather than a step up or down.
+func (c *NomadConnection) scaleJob(action Action) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	index := uint64(r.Int())
+
+	if c.region.Config.NomadReadOnly {
+		logger.Errorf("Unable to scale job: NomadReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "The backend server is in read-only mode", Index: index})
+		return
+	}
+
+	params, ok := action.Payload.(map[string]interface{})
+	if !ok {
+		c.Errorf("Could not decode payload")
+		return
+	}
+
+	jobID, _ := params["job"].(string)
+	taskGroupID, _ := params["taskGroup"].(string)
+	count, ok := params["count"].(float64)
+
+	if jobID == "" || taskGroupID == "" || !ok || count < 0 || count != float64(int(count)) {
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to scale job - a job, a task group and a positive count are required", Index: index})
+		return
+	}
+
+	job, _, err := c.region.Client.Jobs().Info(jobID, nil)
+	if err != nil {
+		c.Errorf("connection: unable to fetch job info: %s", err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Could not find job: %s", jobID), Index: index})
+		return
+	}
+
+	var foundTaskGroup *api.TaskGroup
+	for _, taskGroup := range job.TaskGroups {
+		if taskGroup.Name == taskGroupID {
+			foundTaskGroup = taskGroup
+			break
+		}
+	}
+
+	if foundTaskGroup == nil {
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Could not find Task Group: %s", taskGroupID), Index: index})
+		return
+	}
+
+	originalCount := foundTaskGroup.Count
+	foundTaskGroup.Count = int(count)
+
+	evalID, _, err := c.region.Client.Jobs().Register(job, nil)
+	if err != nil {
+		logger.Errorf("connection: unable to scale job '%s' : %s", jobID, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to scale job : %s", err), Index: index})
+		return
+	}
+
+	logger.Infof("connection: successfully scaled %s:%s from %d to %d", jobID, taskGroupID, originalCount, foundTaskGroup.Count)
+	c.reply(action, &Action{Type: scaledJob, Payload: struct {
+		JobID     string
+		TaskGroup string
+		Count     int
+		EvalID    string
+	}{
+		JobID:     jobID,
+		TaskGroup: taskGroupID,
+		Count:     foundTaskGroup.Count,
+		EvalID:    evalID,
+	}, Index: index})
+	c.reply(action, &Action{Type: successNotification, Payload: fmt.Sprintf("Successfully scaled task group %s:%s from %d to %d", jobID, taskGroupID, originalCount, foundTaskGroup.Count), Index: index})
 }
 
 func (c *NomadConnection) evaluateJob(action Action) {
@@ -937,7 +1775,7 @@ func (c *NomadConnection) evaluateJob(action Action) {
 
 	if c.region.Config.NomadReadOnly {
 		logger.Errorf("Unable to evaluate job: NomadReadOnly is set to true")
-		c.send <- &Action{Type: errorNotification, Payload: "The backend server is in read-only mode", Index: index}
+		c.reply(action, &Action{Type: errorNotification, Payload: "The backend server is in read-only mode", Index: index})
 		return
 	}
 
@@ -945,15 +1783,63 @@ func (c *NomadConnection) evaluateJob(action Action) {
 
 	logger.Infof("Begin evaluate of job with id: %s", jobID)
 
-	_, _, err := c.region.Client.Jobs().ForceEvaluate(jobID, nil)
+	evalID, _, err := c.region.Client.Jobs().ForceEvaluate(jobID, nil)
 	if err != nil {
 		logger.Errorf("connection: unable to evaluate job '%s' : %s", jobID, err)
-		c.send <- &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to evaluate job : %s", err), Index: index}
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to evaluate job : %s", err), Index: index})
 		return
 	}
 
 	logger.Infof("connection: successfully re-evaluated job '%s'", jobID)
-	c.send <- &Action{Type: successNotification, Payload: "The job has been successfully re-evaluated.", Index: index}
+	c.reply(action, &Action{Type: evaluatedJob, Payload: struct {
+		JobID  string
+		EvalID string
+	}{
+		JobID:  jobID,
+		EvalID: evalID,
+	}, Index: index})
+	c.reply(action, &Action{Type: successNotification, Payload: "The job has been successfully re-evaluated.", Index: index})
+}
+
+func (c *NomadConnection) forcePeriodicJob(action Action) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	index := uint64(r.Int())
+
+	if c.region.Config.NomadReadOnly {
+		logger.Errorf("Unable to force periodic job: NomadReadOnly is set to true")
+		c.reply(action, &Action{Type: errorNotification, Payload: "The backend server is in read-only mode", Index: index})
+		return
+	}
+
+	jobID, ok := action.Payload.(string)
+	if !ok || jobID == "" {
+		c.Errorf("Could not decode payload")
+		c.reply(action, &Action{Type: errorNotification, Payload: "Unable to force periodic job - a job ID is required", Index: index})
+		return
+	}
+
+	logger.Infof("Begin periodic force of job with id: %s", jobID)
+
+	evalID, _, err := c.region.Client.Jobs().PeriodicForce(jobID, nil)
+	if err != nil {
+		logger.Errorf("connection: unable to force periodic job '%s' : %s", jobID, err)
+		c.reply(action, &Action{Type: errorNotification, Payload: fmt.Sprintf("Unable to force periodic job : %s", err), Index: index})
+		return
+	}
+
+	logger.Infof("connection: successfully forced periodic job '%s' (eval: %s)", jobID, evalID)
+	c.reply(action, &Action{
+		Type: forcedNomadPeriodicJob,
+		Payload: struct {
+			JobID  string
+			EvalID string
+		}{
+			JobID:  jobID,
+			EvalID: evalID,
+		},
+		Index: index,
+	})
+	c.reply(action, &Action{Type: successNotification, Payload: "The periodic job has been successfully launched.", Index: index})
 }
 
 func (c *NomadConnection) fetchRegions() {
@@ -9,11 +9,6 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	// Allow all requests
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
 // NomadHub keeps track of all the websocket connections and sends state updates
 // from Nomad to all connections.
 type NomadHub struct {
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// upgrader upgrades the requests of both the Consul and Nomad hubs to websockets
+var upgrader = websocket.Upgrader{
+	// Allow all requests, unless websocket-allowed-origins is set (see allowedOriginChecker)
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// allowedOriginChecker returns a CheckOrigin accepting the websocket upgrades coming from one of
+// the allowed origins only, the upgrader refusing the others with a 403. An allowed origin is
+// either a full origin (https://ui.example.com) or a host name matching any scheme. Requests
+// without an Origin header don't come from a browser, so cross-site hijacking doesn't apply.
+func allowedOriginChecker(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil {
+			logger.Warningf("transport: refusing websocket with malformed origin %q", origin)
+			return false
+		}
+
+		for _, allowedOrigin := range allowed {
+			if strings.EqualFold(allowedOrigin, origin) || strings.EqualFold(allowedOrigin, u.Host) {
+				return true
+			}
+		}
+
+		logger.Warningf("transport: refusing websocket from origin %s, which isn't allowed", origin)
+		return false
+	}
+}
+
+const (
+	// Time allowed to write a message to the client
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the client
+	pongWait = 60 * time.Second
+
+	// Send pings to the client with this period, must be less than pongWait
+	pingPeriod = 30 * time.Second
+
+	// Maximum number of actions written to the client in a single frame
+	maxActionBatchSize = 50
+)
+
+// batchActions drains the actions already queued on send after first, up to
+// maxActionBatchSize. A lone action is returned as is, several as a slice,
+// which the frontend splits back into individual actions.
+func batchActions(first *Action, send chan *Action) interface{} {
+	batch := []*Action{first}
+
+drain:
+	for len(batch) < maxActionBatchSize {
+		select {
+		case action, ok := <-send:
+			if !ok {
+				break drain
+			}
+			batch = append(batch, action)
+		default:
+			break drain
+		}
+	}
+
+	if len(batch) == 1 {
+		return first
+	}
+
+	return batch
+}
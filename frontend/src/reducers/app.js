@@ -22,6 +22,16 @@ export function ErrorNotificationReducer (state = {}, action) {
 
     }
   case ERROR_NOTIFICATION:
+    // failing watches send a { Message, WatchKey, Severity } payload, everything else a plain string
+    if (action.payload && typeof action.payload === 'object') {
+      return {
+        message: action.payload.Message,
+        watchKey: action.payload.WatchKey,
+        severity: action.payload.Severity,
+        index: action.index
+      }
+    }
+
     return {
       message: action.payload,
       index: action.index
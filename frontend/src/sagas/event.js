@@ -127,10 +127,16 @@ function subscribe (socket) {
     // eslint-disable-next-line no-param-reassign
     socket.onmessage = (event) => {
       const data = JSON.parse(event.data)
-      emit({
-        type: data.Type,
-        payload: data.Payload,
-        index: data.Index,
+
+      // the backend batches bursts of actions into a single array frame
+      const actions = Array.isArray(data) ? data : [data]
+
+      actions.forEach((action) => {
+        emit({
+          type: action.Type,
+          payload: action.Payload,
+          index: action.Index,
+        })
       })
     }
 